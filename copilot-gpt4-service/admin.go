@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"copilot-gpt4-service/config"
+	"copilot-gpt4-service/keys"
+	"copilot-gpt4-service/log"
+	"copilot-gpt4-service/usage"
+)
+
+// Only requests carrying the ADMIN_TOKEN may use the admin API.
+func AdminAuthHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		adminToken := config.ConfigInstance.AdminToken
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			respondWithError(c, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		c.Next()
+	}
+}
+
+// Request body of creating an API key.
+type createKeyRequest struct {
+	Name      string   `json:"name"`
+	Endpoints []string `json:"endpoints"`
+	Models    []string `json:"models"`
+	ExpiresAt int64    `json:"expires_at"`
+	ExpiresIn int64    `json:"expires_in"`
+}
+
+// An API key together with its secret, returned only when the secret is generated.
+type keyWithSecret struct {
+	*keys.Key
+	Secret string `json:"key"`
+}
+
+// Respond with the status matching the error of the key store.
+func respondWithKeyError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, keys.ErrNotFound):
+		respondWithError(c, http.StatusNotFound, err.Error())
+	case errors.Is(err, keys.ErrRevoked):
+		respondWithError(c, http.StatusConflict, err.Error())
+	default:
+		log.ZLog.Log.Error().Err(err).Msg("API key operation failed")
+		respondWithError(c, http.StatusInternalServerError, "API key operation failed: "+err.Error())
+	}
+}
+
+func createKey(c *gin.Context) {
+	var body createKeyRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+	if body.Name == "" {
+		respondWithError(c, http.StatusBadRequest, "Name cannot be empty.")
+		return
+	}
+	expiresAt := body.ExpiresAt
+	if expiresAt == 0 && body.ExpiresIn > 0 {
+		expiresAt = time.Now().Unix() + body.ExpiresIn
+	}
+
+	key, secret, err := keys.StoreInstance.Create(body.Name, body.Endpoints, body.Models, expiresAt)
+	if err != nil {
+		respondWithKeyError(c, err)
+		return
+	}
+	log.ZLog.Log.Info().Msgf("API key created, id: %s, name: %s", key.ID, key.Name)
+	c.JSON(http.StatusCreated, keyWithSecret{Key: key, Secret: secret})
+}
+
+func listKeys(c *gin.Context) {
+	list, err := keys.StoreInstance.List()
+	if err != nil {
+		respondWithKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   list,
+	})
+}
+
+func getKey(c *gin.Context) {
+	key, err := keys.StoreInstance.Get(c.Param("id"))
+	if err != nil {
+		respondWithKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
+func rotateKey(c *gin.Context) {
+	key, secret, err := keys.StoreInstance.Rotate(c.Param("id"))
+	if err != nil {
+		respondWithKeyError(c, err)
+		return
+	}
+	log.ZLog.Log.Info().Msgf("API key rotated, id: %s, name: %s", key.ID, key.Name)
+	c.JSON(http.StatusOK, keyWithSecret{Key: key, Secret: secret})
+}
+
+func revokeKey(c *gin.Context) {
+	key, err := keys.StoreInstance.Revoke(c.Param("id"))
+	if err != nil {
+		respondWithKeyError(c, err)
+		return
+	}
+	log.ZLog.Log.Info().Msgf("API key revoked, id: %s, name: %s", key.ID, key.Name)
+	c.JSON(http.StatusOK, key)
+}
+
+// Parse a time query parameter, given as unix timestamp or as date (2006-01-02, UTC).
+func parseTimeQuery(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// Aggregate the usage ledger, e.g. /admin/usage?group_by=key,model,day&from=2024-01-01&format=csv
+func usageReport(c *gin.Context) {
+	query := usage.Query{GroupBy: []string{}}
+	for _, group := range strings.Split(c.DefaultQuery("group_by", "key,model,day"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			query.GroupBy = append(query.GroupBy, group)
+		}
+	}
+	var err error
+	if query.From, err = parseTimeQuery(c.Query("from")); err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid from: "+err.Error())
+		return
+	}
+	if query.To, err = parseTimeQuery(c.Query("to")); err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid to: "+err.Error())
+		return
+	}
+
+	summaries, err := usage.LedgerInstance.Summarize(query)
+	if errors.Is(err, usage.ErrInvalidGroup) {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Summarize usage failed")
+		respondWithError(c, http.StatusInternalServerError, "Summarize usage failed: "+err.Error())
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{
+			"object": "list",
+			"data":   summaries,
+		})
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="usage.csv"`)
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		_ = w.Write(append(append([]string{}, query.GroupBy...),
+			"requests", "errors", "prompt_tokens", "completion_tokens", "total_tokens", "avg_latency_ms"))
+		for _, s := range summaries {
+			row := make([]string, 0, len(query.GroupBy)+6)
+			for _, group := range query.GroupBy {
+				switch group {
+				case "key":
+					row = append(row, s.Key)
+				case "model":
+					row = append(row, s.Model)
+				case "day":
+					row = append(row, s.Day)
+				}
+			}
+			row = append(row,
+				strconv.FormatInt(s.Requests, 10),
+				strconv.FormatInt(s.Errors, 10),
+				strconv.FormatInt(s.PromptTokens, 10),
+				strconv.FormatInt(s.CompletionTokens, 10),
+				strconv.FormatInt(s.TotalTokens, 10),
+				strconv.FormatFloat(s.AvgLatencyMs, 'f', 1, 64),
+			)
+			_ = w.Write(row)
+		}
+		w.Flush()
+	default:
+		respondWithError(c, http.StatusBadRequest, "Invalid format, valid formats are json, csv.")
+	}
+}
@@ -1,19 +1,18 @@
 package cache
 
 import (
-	"copilot-gpt4-service/config"
 	"copilot-gpt4-service/log"
 	"copilot-gpt4-service/tools"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
-
-	_ "modernc.org/sqlite"
 )
 
 const (
@@ -21,8 +20,9 @@ const (
 	clean_timeout     int64 = 60 * 60 * 24 * 7 // 7 days
 )
 
-// CacheInstance is a global variable that is used to access the cache.
-var CacheInstance *Cache = NewCache(config.ConfigInstance.Cache, config.ConfigInstance.CachePath)
+// CacheInstance is a global variable that is used to access the cache, created by the service
+// once the configuration is loaded.
+var CacheInstance *Cache
 
 type Authorization struct {
 	App_token          string `db:"app_token"`
@@ -34,108 +34,252 @@ type Authorization struct {
 	Last_touched       int64  `db:"last_touched,omitempty"`
 }
 
-// Cache is a struct that contains the cache information.
+// Store keeps the items of the cache. The backend is chosen by the URL of the cache, see Open.
+type Store interface {
+	// Get the item, false if it does not exist.
+	Get(app_token string) (Authorization, bool, error)
+	// Update the item with fn, which is told whether the item exists. The item is stored if
+	// fn returns true, Update returns what fn returned. The read and the write are atomic,
+	// fn may be called again if the item is changed concurrently.
+	Update(app_token string, fn func(item *Authorization, exists bool) bool) (bool, error)
+	// Delete the item.
+	Delete(app_token string) error
+	// Delete the items last touched before the given Unix time, return their app tokens.
+	DeleteUntouched(before int64) ([]string, error)
+	// List every item.
+	List() ([]Authorization, error)
+	// Close the store.
+	Close() error
+}
+
+// Open the store at the URL: memory://, sqlite://<path> or redis://<user>:<password>@<host>:<port>/<db>
+// (rediss:// with TLS).
+func Open(url string) (Store, error) {
+	scheme, path, _ := strings.Cut(url, "://")
+	switch scheme {
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return openSQLiteStore(path)
+	case "redis", "rediss":
+		return openRedisStore(url)
+	}
+	return nil, fmt.Errorf("unsupported cache URL scheme %q, expected memory, sqlite, redis or rediss", scheme)
+}
+
+// Cache is a struct that contains the cache information. The app tokens and the Copilot
+// tokens are not stored in plaintext, see sealer.
 type Cache struct {
-	cache      bool
-	cache_path string
-	Db         *sqlx.DB
-	Data       map[string]Authorization
+	url     string
+	key     string
+	keyFile string
+	mu      sync.Mutex // guards the store and the sealer
+	store   Store
+	sealer  *sealer
 }
 
-// Create a new Cache instance.
-func NewCache(cache bool, cache_path string) *Cache {
+// Create a new Cache instance with the store at the URL, which is opened on first use.
+// The tokens are protected with the keys, see loadKeys, or else with the keys in the key
+// file. A sqlite cache creates the key file next to the database if neither is set.
+func NewCache(url string, key string, keyFile string) *Cache {
 	c := &Cache{
-		cache:      cache,
-		cache_path: cache_path,
+		url:     url,
+		key:     key,
+		keyFile: keyFile,
 	}
 	return c
 }
 
-// Create table
-func (c *Cache) createTable() error {
-	if !c.cache {
-		return errors.New("cache is disabled")
-	}
-	if c.Db == nil {
-		return errors.New("database is not connected")
-	}
-	// create table
-	_, err := c.Db.Exec(`
-		CREATE TABLE IF NOT EXISTS cache(
-			app_token TEXT PRIMARY KEY,
-			c_token TEXT DEFAULT '',
-			expires_at INTEGER DEFAULT 0,
-			vscode_machineid TEXT DEFAULT '',
-			vscode_sessionid TEXT DEFAULT '',
-			session_expires_at INTEGER DEFAULT 0,
-			last_touched INTEGER DEFAULT 0
-		)
-	`)
-	return err
+// Load the keys of the cache, the tokens of the in-memory cache are protected with a random key.
+func (c *Cache) loadSealer() (*sealer, error) {
+	if strings.HasPrefix(c.url, "memory://") {
+		secret := make([]byte, keyLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		return newSealer([][]byte{secret})
+	}
+	path, isSQLite := strings.CutPrefix(c.url, "sqlite://")
+	keyFile := c.keyFile
+	if keyFile == "" && isSQLite {
+		keyFile = path + ".key"
+	}
+	secrets, err := loadKeys(c.key, keyFile, isSQLite)
+	if err != nil {
+		return nil, err
+	}
+	return newSealer(secrets)
 }
 
-// Connect to the database or initialize the map
-func (c *Cache) connect() {
-	if c.cache && c.Db == nil {
-		// create cache directory if not exists
-		if err := tools.MkdirAllIfNotExists(c.cache_path, os.ModePerm); err != nil {
-			log.ZLog.Log.Error().Err(err).Msg("Create cache directory failed, cache_path: " + c.cache_path + ". Please check the configuration file.")
-			panic(err)
-		}
+// Load the keys of the cache if not loaded yet, so that a missing or invalid key is reported
+// when the service starts instead of on the first request.
+func (c *Cache) LoadKeys() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sealer != nil {
+		return nil
+	}
+	sealer, err := c.loadSealer()
+	if err != nil {
+		return err
+	}
+	c.sealer = sealer
+	return nil
+}
 
-		// connect to database
-		var err error
-		c.Db, err = sqlx.Connect("sqlite", c.cache_path)
+// Connect to the store if not connected yet. When connecting, the items stored by older
+// releases are moved to the current key and the Copilot tokens encrypted with a former key
+// are encrypted again, see reseal.
+func (c *Cache) connect() (Store, *sealer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sealer == nil {
+		sealer, err := c.loadSealer()
 		if err != nil {
-			log.ZLog.Log.Error().Err(err).Msg("Connect to database failed. Please check cache database path, cache_path: " + c.cache_path)
+			log.ZLog.Log.Error().Err(err).Msg("Load the cache key failed. Please check the configuration of CACHE_KEY or CACHE_KEY_FILE.")
 			panic(err)
 		}
-		// create table if not exists
-		// _, err = c.Db.Exec("CREATE TABLE IF NOT EXISTS cache(app_token TEXT PRIMARY KEY, c_token TEXT, expires_at INTEGER, vscode_machineid TEXT, vscode_sessionid TEXT, session_expires_at INTEGER, last_touched INTEGER)") and setdefault
-		err = c.createTable()
+		c.sealer = sealer
+	}
+	if c.store == nil {
+		store, err := Open(c.url)
 		if err != nil {
-			log.ZLog.Log.Error().Err(err).Msg("Create cache table failed.")
+			scheme, _, _ := strings.Cut(c.url, "://")
+			log.ZLog.Log.Error().Err(err).Msg("Connect to the " + scheme + " cache failed. Please check the configuration of CACHE_URL or CACHE_PATH.")
 			panic(err)
 		}
-		// recreate table if not exists
-		// check if vscode_machineid exists
-		var vscode_machineid string
-		err = c.Db.Get(&vscode_machineid, "SELECT vscode_machineid FROM cache LIMIT 1")
-		if err != nil && err.Error() != "sql: no rows in result set" {
-			// drop table and recreate
-			_, err = c.Db.Exec("DROP TABLE cache")
-			if err != nil {
-				log.ZLog.Log.Error().Err(err).Msg("drop cache table failed")
-				panic(err)
+		c.store = store
+		if resealed, err := reseal(store, c.sealer); err != nil {
+			log.ZLog.Log.Error().Err(err).Msg("Move the cache items to the current cache key failed")
+		} else if resealed > 0 {
+			log.ZLog.Log.Info().Msgf("Moved %d cache items to the current cache key", resealed)
+		}
+	}
+	return c.store, c.sealer
+}
+
+// Move the items to the current key: the items stored by older releases are stored under the
+// hash of their app token instead, and the Copilot tokens encrypted with a former key are
+// encrypted again. The items hashed with a former key are moved when they are read, see get.
+func reseal(store Store, sealer *sealer) (int, error) {
+	items, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	resealed := 0
+	for _, item := range items {
+		from := item.App_token
+		if isLegacyID(from) {
+			if err := move(store, sealer, from, from, item); err != nil {
+				return resealed, err
 			}
-			err = c.createTable()
+			resealed++
+			continue
+		}
+		if sealer.isCurrent(item.C_token) {
+			continue
+		}
+		ok, err := store.Update(from, func(item *Authorization, exists bool) bool {
+			if !exists || sealer.isCurrent(item.C_token) {
+				return false
+			}
+			c_token, err := sealer.open(from, item.C_token)
 			if err != nil {
-				log.ZLog.Log.Error().Err(err).Msg("create cache table failed")
-				panic(err)
+				log.ZLog.Log.Warn().Err(err).Msg("Decrypt cache item failed, it is left as it is")
+				return false
 			}
+			item.C_token = sealer.seal(from, c_token)
+			return true
+		})
+		if err != nil {
+			return resealed, err
+		}
+		if ok {
+			resealed++
 		}
-	} else if !c.cache && c.Data == nil {
-		c.Data = make(map[string]Authorization)
 	}
+	return resealed, nil
+}
+
+// Move the opened item of the app token from the id it is stored under to the current id,
+// unless an item is stored there already.
+func move(store Store, sealer *sealer, from string, app_token string, item Authorization) error {
+	id := sealer.id(app_token)
+	_, err := store.Update(id, func(current *Authorization, exists bool) bool {
+		if exists {
+			return false
+		}
+		*current = sealer.sealItem(id, item)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return store.Delete(from)
+}
+
+// Update the item of the app token with fn, which sees the item in plaintext, see Store.Update.
+func (c *Cache) update(app_token string, fn func(item *Authorization, exists bool) bool) (bool, error) {
+	store, sealer := c.connect()
+	id := sealer.id(app_token)
+	return store.Update(id, func(item *Authorization, exists bool) bool {
+		opened := Authorization{}
+		if exists {
+			var err error
+			if opened, err = sealer.openItem(app_token, *item); err != nil {
+				log.ZLog.Log.Warn().Err(err).Msg("Decrypt cache item failed, it is replaced")
+				opened, exists = Authorization{}, false
+			}
+		}
+		if !fn(&opened, exists) {
+			return false
+		}
+		*item = sealer.sealItem(id, opened)
+		return true
+	})
+}
+
+// HasDB reports whether the cache is stored in a sqlite database, see DB.
+func (c *Cache) HasDB() bool {
+	return strings.HasPrefix(c.url, "sqlite://")
+}
+
+// DB returns the connection of the sqlite cache database, which other tables of
+// the service live in as well. It fails if the cache is stored elsewhere.
+func (c *Cache) DB() (*sqlx.DB, error) {
+	if !c.HasDB() {
+		return nil, errors.New("the cache is not stored in a sqlite database")
+	}
+	store, _ := c.connect()
+	return store.(*sqliteStore).db, nil
 }
 
 // get record
 func (c *Cache) get(app_token string) (Authorization, bool) {
-	c.connect()
-	if c.cache {
-		var authorization Authorization
-		err := c.Db.Get(&authorization, "SELECT * FROM cache WHERE app_token = ?", app_token)
+	store, sealer := c.connect()
+	for i, id := range sealer.candidates(app_token) {
+		item, ok, err := store.Get(id)
 		if err != nil {
-			log.ZLog.Log.Warn().Msg("Get authorization from cache failed, app_token: " + app_token)
+			log.ZLog.Log.Warn().Err(err).Msg("Get authorization from cache failed, app_token: " + log.Fingerprint(app_token))
 			return Authorization{}, false
 		}
-		return authorization, true
-	} else {
-		if authorization, ok := c.Data[app_token]; ok {
-			return authorization, true
+		if !ok {
+			continue
 		}
-		return Authorization{}, false
+		authorization, err := sealer.openItem(app_token, item)
+		if err != nil {
+			log.ZLog.Log.Warn().Err(err).Msg("Decrypt authorization from cache failed, app_token: " + log.Fingerprint(app_token))
+			return Authorization{}, false
+		}
+		// stored by an older release or with a former key
+		if i > 0 {
+			if err := move(store, sealer, id, app_token, authorization); err != nil {
+				log.ZLog.Log.Warn().Err(err).Msg("Move authorization to the current cache key failed, app_token: " + log.Fingerprint(app_token))
+			}
+		}
+		return authorization, true
 	}
+	return Authorization{}, false
 }
 
 // update authorization to item (ignore zero value)
@@ -165,94 +309,86 @@ func (c *Cache) updateItem(item *Authorization, authorization Authorization) {
 
 // update record
 func (c *Cache) modify(app_token string, authorization Authorization) error {
-	log.ZLog.Log.Debug().Msg(fmt.Sprint("Modify cache record, app_token: ", app_token, ", authorization: ", authorization))
-	c.connect()
-	// try to get
-	item, ok := c.get(app_token)
-	if c.cache {
-		if ok {
-			c.updateItem(&item, authorization)
-			// update
-			_, err := c.Db.Exec("UPDATE cache SET c_token = ?, expires_at = ?, vscode_machineid = ?, vscode_sessionid = ?, session_expires_at = ?, last_touched = ? WHERE app_token = ?", item.C_token, item.ExpiresAt, item.Vscode_machineid, item.Vscode_sessionid, item.Session_expires_at, item.Last_touched, app_token)
-			if err != nil {
-				log.ZLog.Log.Error().Err(err).Msg("update cache failed, app_token: " + app_token)
-				return err
-			}
+	log.ZLog.Log.Debug().Msg("Modify cache record, app_token: " + log.Fingerprint(app_token))
+	_, err := c.update(app_token, func(item *Authorization, exists bool) bool {
+		if exists {
+			c.updateItem(item, authorization)
 		} else {
-			// insert
-			_, err := c.Db.Exec("INSERT INTO cache VALUES (?, ?, ?, ?, ?, ?, ?)", app_token, authorization.C_token, authorization.ExpiresAt, authorization.Vscode_machineid, authorization.Vscode_sessionid, authorization.Session_expires_at, authorization.Last_touched)
-			if err != nil {
-				log.ZLog.Log.Error().Err(err).Msg("Insert cache failed, app_token: " + app_token)
-				return err
-			}
-		}
-	} else {
-		if ok {
-			c.updateItem(&item, authorization)
-			// update
-			c.Data[app_token] = item
-		} else {
-			// insert
-			authorization.App_token = app_token
-			c.Data[app_token] = authorization
+			*item = authorization
+			item.App_token = app_token
 		}
+		return true
+	})
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Modify cache failed, app_token: " + log.Fingerprint(app_token))
 	}
-	return nil
+	return err
 }
 
-// update_session sessionid
-func (c *Cache) update_session(app_token string) bool {
-	c.connect()
+// the fields of the item to update when it is touched
+func (c *Cache) sessionUpdate(app_token string, item Authorization) Authorization {
 	to_update := Authorization{Last_touched: time.Now().Unix()}
-	item, ok := c.get(app_token)
-	if !ok {
-		return false
-	}
 	// if session expires, update
 	if item.Session_expires_at < time.Now().Unix() {
 		to_update.Vscode_sessionid = uuid.NewString() + strconv.FormatInt(time.Now().UnixMilli(), 10)
 		to_update.Session_expires_at = time.Now().Unix() + sessionid_timeout
-		log.ZLog.Log.Debug().Msg(fmt.Sprintf("Session expires, update sessionid, app_token: %s, sessionid: %s, session_expires_at: %d", app_token, to_update.Vscode_sessionid, to_update.Session_expires_at))
+		log.ZLog.Log.Debug().Msg(fmt.Sprintf("Session expires, update sessionid, app_token: %s, sessionid: %s, session_expires_at: %d", log.Fingerprint(app_token), to_update.Vscode_sessionid, to_update.Session_expires_at))
 	}
 	if item.Vscode_machineid == "" {
 		to_update.Vscode_machineid = tools.GenMachineId()
-		log.ZLog.Log.Debug().Msg(fmt.Sprintf("Vscode_machineid is empty, generate new one, app_token: %s, vscode_machineid: %s", app_token, to_update.Vscode_machineid))
+		log.ZLog.Log.Debug().Msg(fmt.Sprintf("Vscode_machineid is empty, generate new one, app_token: %s, vscode_machineid: %s", log.Fingerprint(app_token), to_update.Vscode_machineid))
 	}
-	// update
-	err := c.modify(app_token, to_update)
-	return err == nil
+	return to_update
 }
 
-// clean items that have not been touched for a long time
-func (c *Cache) clean() {
-	c.connect()
-	expirationTime := time.Now().Unix() - clean_timeout
-
-	logExpiredItem := func(app_token string) {
-		logMessage := "Clean app_token: %s, the item has not been touched for a long time"
-		log.ZLog.Log.Debug().Msg(fmt.Sprintf(logMessage, app_token))
-	}
-
-	if c.cache {
-		// get all items with last_touched < now - clean_timeout
-		var items []Authorization
-		err := c.Db.Select(&items, "SELECT * FROM cache WHERE last_touched < ?", time.Now().Unix()-clean_timeout)
-		if err == nil {
-			// delete
-			for _, item := range items {
-				c.Delete(item.App_token)
-				logExpiredItem(item.App_token)
-			}
+// update_session sessionid
+func (c *Cache) update_session(app_token string) bool {
+	// touch the item atomically, so that concurrent requests agree on the session,
+	// and only write it if it changed, so that they rarely conflict
+	found := false
+	_, err := c.update(app_token, func(item *Authorization, exists bool) bool {
+		found = exists
+		if !exists {
+			return false
 		}
-	} else {
-		// get all items with last_touched < now - clean_timeout
-		for app_token, item := range c.Data {
-			if item.Last_touched < expirationTime {
-				c.Delete(app_token)
-				logExpiredItem(item.App_token)
-			}
+		touched := *item
+		c.updateItem(&touched, c.sessionUpdate(app_token, *item))
+		if touched == *item {
+			return false
 		}
+		*item = touched
+		return true
+	})
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Update session failed, app_token: " + log.Fingerprint(app_token))
+		return false
 	}
+	return found
+}
+
+// clean items that have not been touched for a long time, return the number of items removed
+func (c *Cache) clean() int {
+	store, _ := c.connect()
+	removed, err := store.DeleteUntouched(time.Now().Unix() - clean_timeout)
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Clean cache failed")
+		return 0
+	}
+	for _, id := range removed {
+		logMessage := "Clean item %s, the item has not been touched for a long time"
+		log.ZLog.Log.Debug().Msg(fmt.Sprintf(logMessage, id))
+	}
+	return len(removed)
+}
+
+// Clean removes the items that have not been touched for a long time and returns how many were removed.
+func (c *Cache) Clean() int {
+	return c.clean()
+}
+
+// Peek returns the Authorization from the cache without touching it, unlike Get.
+func (c *Cache) Peek(app_token string) (Authorization, bool) {
+	return c.get(app_token)
 }
 
 // Get the Authorization from the cache.
@@ -262,10 +398,10 @@ func (c *Cache) Get(app_token string) (Authorization, bool) {
 		return auth, ok
 	}
 
-	log.ZLog.Log.Debug().Msg(fmt.Sprintf("Get authorization from cache success, app_token: %s, will update session expire time", app_token))
+	log.ZLog.Log.Debug().Msg(fmt.Sprintf("Get authorization from cache success, app_token: %s, will update session expire time", log.Fingerprint(app_token)))
 	ok = c.update_session(app_token)
 
-	old_auth_return_message := fmt.Sprint("Return the original authorization, app_token: ", app_token, ", authorization: ", auth)
+	old_auth_return_message := "Return the original authorization, app_token: " + log.Fingerprint(app_token)
 	if !ok {
 		log.ZLog.Log.Error().Msg(fmt.Sprintf("Update session failed, %s", old_auth_return_message))
 		return auth, ok
@@ -280,24 +416,21 @@ func (c *Cache) Get(app_token string) (Authorization, bool) {
 
 // Set the Authorization in the cache.
 func (c *Cache) Set(app_token string, authorization Authorization) bool {
-	c.connect()
 	now := time.Now().Unix()
-	item, ok := c.get(app_token)
-	if ok { // if exists, update
+	_, err := c.update(app_token, func(item *Authorization, exists bool) bool {
+		if !exists {
+			*item = Authorization{
+				App_token:        app_token,
+				Vscode_machineid: tools.GenMachineId(),
+			}
+		}
 		item.C_token = authorization.C_token
 		item.ExpiresAt = authorization.ExpiresAt
 		item.Last_touched = now
-	} else {
-		item = Authorization{
-			App_token:        app_token,
-			C_token:          authorization.C_token,
-			ExpiresAt:        authorization.ExpiresAt,
-			Vscode_machineid: tools.GenMachineId(),
-			Last_touched:     now,
-		}
-	}
-	err := c.modify(app_token, item)
+		return true
+	})
 	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Set cache failed, app_token: " + log.Fingerprint(app_token))
 		return false
 	}
 	return c.update_session(app_token)
@@ -305,28 +438,30 @@ func (c *Cache) Set(app_token string, authorization Authorization) bool {
 
 // Delete the Authorization from the cache.
 func (c *Cache) Delete(app_token string) error {
-	c.connect()
-	if c.cache {
-		_, err := c.Db.Exec("DELETE FROM cache WHERE app_token = ?", app_token)
-		if err != nil {
-			log.ZLog.Log.Error().Err(err).Msg("Delete cache item failed, app_token: " + app_token)
+	store, sealer := c.connect()
+	for _, id := range sealer.candidates(app_token) {
+		if err := store.Delete(id); err != nil {
+			log.ZLog.Log.Error().Err(err).Msg("Delete cache item failed, app_token: " + log.Fingerprint(app_token))
 			return err
 		}
-		return nil
-	} else {
-		delete(c.Data, app_token)
-		return nil
 	}
+	return nil
 }
 
-// Close the database connection.
+// Close the connection of the store.
 func (c *Cache) Close() {
-	if c.cache && c.Db != nil {
-		c.clean()
-		c.Db.Close()
-		c.Db = nil
-	} else if !c.cache && c.Data != nil {
-		c.clean()
-		c.Data = nil
+	c.mu.Lock()
+	connected := c.store != nil
+	c.mu.Unlock()
+	if !connected {
+		return
+	}
+	c.clean()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.Close(); err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Close cache failed")
 	}
+	c.store = nil
 }
@@ -0,0 +1,319 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"copilot-gpt4-service/log"
+)
+
+// Keys of the tests, base64 encoded.
+const (
+	testKey      = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testKeyNext  = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+	testAppToken = "ghu_secret_app_token"
+	testCToken   = "tid=secret_copilot_token"
+)
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Run the test against every backend, Redis is stood in for by an in-process server.
+func forEachStore(t *testing.T, test func(t *testing.T, c *Cache)) {
+	stores := []struct {
+		name string
+		url  func(t *testing.T) string
+	}{
+		{"memory", func(t *testing.T) string { return "memory://" }},
+		{"sqlite", func(t *testing.T) string { return "sqlite://" + t.TempDir() + "/cache.sqlite3" }},
+		{"redis", func(t *testing.T) string { return "redis://" + miniredis.RunT(t).Addr() }},
+	}
+	for _, store := range stores {
+		t.Run(store.name, func(t *testing.T) {
+			c := NewCache(store.url(t), testKey, "")
+			defer c.Close()
+			test(t, c)
+		})
+	}
+}
+
+// Hammer the cache from many goroutines, run with -race to catch unsynchronized access.
+func TestConcurrentAccess(t *testing.T) {
+	forEachStore(t, testConcurrentAccess)
+}
+
+func testConcurrentAccess(t *testing.T, c *Cache) {
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			own := fmt.Sprintf("own-%d", w)
+			for i := 0; i < rounds; i++ {
+				shared := fmt.Sprintf("shared-%d", i%4)
+				c.Set(shared, Authorization{C_token: "c-" + shared, ExpiresAt: int64(i + 1)})
+				c.Get(shared)
+				c.Peek(shared)
+				if i%10 == 0 {
+					_ = c.Delete(shared)
+					c.Clean()
+				}
+
+				c.Set(own, Authorization{C_token: fmt.Sprintf("c-%d", i), ExpiresAt: int64(i + 1)})
+				item, ok := c.Get(own)
+				if !ok || item.C_token != fmt.Sprintf("c-%d", i) || item.App_token != own {
+					t.Errorf("unexpected item of %s after round %d: %+v", own, i, item)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// Concurrent reads of the same item must agree on its session, which is created on the first read.
+func TestConcurrentSession(t *testing.T) {
+	forEachStore(t, testConcurrentSession)
+}
+
+func testConcurrentSession(t *testing.T, c *Cache) {
+	c.Set("token", Authorization{C_token: "c", ExpiresAt: time.Now().Unix() + 600})
+
+	var wg sync.WaitGroup
+	sessions := make(chan string, 32)
+	for i := 0; i < cap(sessions); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item, _ := c.Get("token")
+			sessions <- item.Vscode_sessionid + "/" + item.Vscode_machineid
+		}()
+	}
+	wg.Wait()
+	close(sessions)
+
+	first := <-sessions
+	for session := range sessions {
+		if session != first {
+			t.Fatalf("concurrent reads returned different sessions: %q and %q", first, session)
+		}
+	}
+}
+
+// Every backend behaves alike: Set creates or updates, Delete removes
+// and Clean removes the items untouched for a long time.
+func TestCacheSemantics(t *testing.T) {
+	forEachStore(t, testCacheSemantics)
+}
+
+func testCacheSemantics(t *testing.T, c *Cache) {
+	if _, ok := c.Get("token"); ok {
+		t.Fatal("found an item that was never set")
+	}
+	c.Set("token", Authorization{C_token: "first", ExpiresAt: 1})
+	first, ok := c.Get("token")
+	if !ok || first.C_token != "first" || first.Vscode_machineid == "" || first.Vscode_sessionid == "" {
+		t.Fatalf("unexpected item: %+v", first)
+	}
+	c.Set("token", Authorization{C_token: "second", ExpiresAt: 2})
+	second, _ := c.Get("token")
+	if second.C_token != "second" || second.ExpiresAt != 2 || second.Vscode_machineid != first.Vscode_machineid {
+		t.Fatalf("update did not keep the machine id: %+v, before: %+v", second, first)
+	}
+
+	if err := c.modify("token", Authorization{Last_touched: 1}); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("fresh", Authorization{C_token: "fresh"})
+	if removed := c.Clean(); removed != 1 {
+		t.Fatalf("expected 1 untouched item to be removed, got %d", removed)
+	}
+	if _, ok := c.Peek("token"); ok {
+		t.Fatal("untouched item not removed")
+	}
+	if err := c.Delete("fresh"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Peek("fresh"); ok {
+		t.Fatal("deleted item still found")
+	}
+}
+
+// Replicas sharing a Redis server share the items and their sessions.
+func TestRedisShared(t *testing.T) {
+	url := "redis://" + miniredis.RunT(t).Addr()
+	first, second := NewCache(url, testKey, ""), NewCache(url, testKey, "")
+	defer first.Close()
+	defer second.Close()
+
+	first.Set("token", Authorization{C_token: "c", ExpiresAt: time.Now().Unix() + 600})
+	a, _ := first.Get("token")
+	b, ok := second.Get("token")
+	if !ok || b.C_token != "c" || b.Vscode_sessionid != a.Vscode_sessionid || b.Vscode_machineid != a.Vscode_machineid {
+		t.Fatalf("item not shared: %+v, %+v", a, b)
+	}
+}
+
+// A Redis cache has no key file next to it, the key must be configured.
+func TestLoadKeys(t *testing.T) {
+	if err := NewCache("redis://localhost:6379", "", "").LoadKeys(); err == nil {
+		t.Fatal("expected an error for a Redis cache without key")
+	}
+	if err := NewCache("redis://localhost:6379", "invalid", "").LoadKeys(); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+	if err := NewCache("redis://localhost:6379", testKey, "").LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewCache("sqlite://"+t.TempDir()+"/cache.sqlite3", "", "").LoadKeys(); err != nil {
+		t.Fatalf("the key file of a sqlite cache is not created: %v", err)
+	}
+}
+
+func TestOpenUnsupported(t *testing.T) {
+	if _, err := Open("mysql://localhost/cache"); err == nil {
+		t.Fatal("expected an error for an unsupported scheme")
+	}
+}
+
+// Return every stored item, as it is at rest.
+func storedItems(t *testing.T, url string) []Authorization {
+	t.Helper()
+	store, err := Open(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	items, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func expectNoPlaintext(t *testing.T, items []Authorization) {
+	t.Helper()
+	for _, item := range items {
+		if strings.Contains(item.App_token, testAppToken) || strings.Contains(item.C_token, testCToken) {
+			t.Fatalf("token stored in plaintext: %+v", item)
+		}
+	}
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.sqlite3")
+	url := "sqlite://" + path
+	c := NewCache(url, "", "")
+	c.Set(testAppToken, Authorization{C_token: testCToken, ExpiresAt: 1})
+	c.Close()
+
+	if _, err := os.Stat(path + ".key"); err != nil {
+		t.Fatalf("key file not created: %v", err)
+	}
+	items := storedItems(t, url)
+	if len(items) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(items))
+	}
+	expectNoPlaintext(t, items)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), testAppToken) || strings.Contains(string(data), testCToken) {
+		t.Fatal("token found in the database file")
+	}
+
+	// the restarted service reads the token with the key file
+	c = NewCache(url, "", "")
+	defer c.Close()
+	if item, ok := c.Get(testAppToken); !ok || item.C_token != testCToken || item.App_token != testAppToken {
+		t.Fatalf("unexpected item after restart: %+v", item)
+	}
+}
+
+// A database of an older release with plaintext tokens is converted when it is opened.
+func TestLegacyItems(t *testing.T) {
+	url := "sqlite://" + filepath.Join(t.TempDir(), "cache.sqlite3")
+	store, err := Open(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Update(testAppToken, func(item *Authorization, exists bool) bool {
+		*item = Authorization{App_token: testAppToken, C_token: testCToken, ExpiresAt: 1, Vscode_machineid: "machine", Last_touched: time.Now().Unix()}
+		return true
+	})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCache(url, testKey, "")
+	defer c.Close()
+	item, ok := c.Peek(testAppToken)
+	if !ok || item.C_token != testCToken || item.Vscode_machineid != "machine" {
+		t.Fatalf("legacy item not found: %+v", item)
+	}
+	expectNoPlaintext(t, storedItems(t, url))
+}
+
+// After a rotation the items are encrypted with the new key when the cache is opened,
+// and moved to the hash with the new key when they are read.
+func TestKeyRotation(t *testing.T) {
+	url := "redis://" + miniredis.RunT(t).Addr()
+	c := NewCache(url, testKey, "")
+	c.Set(testAppToken, Authorization{C_token: testCToken, ExpiresAt: 1})
+	c.Close()
+
+	c = NewCache(url, testKeyNext+","+testKey, "")
+	defer c.Close()
+	_, sealer := c.connect()
+	items := storedItems(t, url)
+	if len(items) != 1 || !sealer.isCurrent(items[0].C_token) {
+		t.Fatalf("item not encrypted with the new key: %+v", items)
+	}
+	if item, ok := c.Get(testAppToken); !ok || item.C_token != testCToken {
+		t.Fatalf("item not found after rotation: %+v", item)
+	}
+	items = storedItems(t, url)
+	if len(items) != 1 || items[0].App_token != sealer.id(testAppToken) {
+		t.Fatalf("item not moved to the new key: %+v", items)
+	}
+
+	// the former key is not needed anymore
+	c = NewCache(url, testKeyNext, "")
+	defer c.Close()
+	if item, ok := c.Get(testAppToken); !ok || item.C_token != testCToken {
+		t.Fatalf("item not found without the former key: %+v", item)
+	}
+
+	// an item that was not used while the former key was kept is lost with it
+	c = NewCache(url, testKey, "")
+	defer c.Close()
+	c.Set("unused", Authorization{C_token: testCToken, ExpiresAt: 1})
+	c = NewCache(url, testKeyNext+","+testKey, "")
+	defer c.Close()
+	c.connect()
+	c = NewCache(url, testKeyNext, "")
+	defer c.Close()
+	if _, ok := c.Get("unused"); ok {
+		t.Fatal("item read without the key it is stored with")
+	}
+
+	// without the key, the item is not readable
+	c = NewCache(url, testKey, "")
+	defer c.Close()
+	if _, ok := c.Get(testAppToken); ok {
+		t.Fatal("item read with a wrong key")
+	}
+}
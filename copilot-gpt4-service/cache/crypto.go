@@ -0,0 +1,236 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"copilot-gpt4-service/log"
+	"copilot-gpt4-service/tools"
+)
+
+// Prefixes of the hashed app tokens and of the encrypted Copilot tokens, followed by the id
+// of the key and the value. Values without them were stored in plaintext by older releases.
+const (
+	hashPrefix   = "hmac-sha256:"
+	sealedPrefix = "aes-256-gcm:"
+)
+
+// Length of the cache keys, e.g. generated with openssl rand -base64 32.
+const keyLength = 32
+
+// cacheKey is a key of the cache, the keys to hash the app tokens and to encrypt the
+// Copilot tokens are derived from it.
+type cacheKey struct {
+	id   string
+	hash []byte
+	aead cipher.AEAD
+}
+
+func newCacheKey(secret []byte) (*cacheKey, error) {
+	if len(secret) != keyLength {
+		return nil, fmt.Errorf("a cache key must be %d bytes long, got %d", keyLength, len(secret))
+	}
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("copilot-gpt4-service cache encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(secret)
+	return &cacheKey{
+		id:   hex.EncodeToString(sum[:4]),
+		hash: derive("copilot-gpt4-service cache hash"),
+		aead: aead,
+	}, nil
+}
+
+// sealer protects the cached tokens at rest: the items are stored under a keyed hash of
+// their app token and their Copilot token is encrypted, authenticated along with the hash.
+// The first key is the current one, the others are former keys which are still accepted
+// until the items are moved to the current key.
+type sealer struct {
+	keys []*cacheKey
+	byID map[string]*cacheKey
+}
+
+func newSealer(secrets [][]byte) (*sealer, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("no cache key")
+	}
+	s := &sealer{byID: make(map[string]*cacheKey)}
+	for _, secret := range secrets {
+		key, err := newCacheKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = append(s.keys, key)
+		s.byID[key.id] = key
+	}
+	return s, nil
+}
+
+func (s *sealer) idWith(key *cacheKey, app_token string) string {
+	mac := hmac.New(sha256.New, key.hash)
+	mac.Write([]byte(app_token))
+	return hashPrefix + key.id + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return the id the item of the app token is stored under with the current key.
+func (s *sealer) id(app_token string) string {
+	return s.idWith(s.keys[0], app_token)
+}
+
+// Return the ids the item of the app token may be stored under, in order: with the current
+// key, with the former keys, and the app token itself in the databases of older releases.
+func (s *sealer) candidates(app_token string) []string {
+	ids := make([]string, 0, len(s.keys)+1)
+	for _, key := range s.keys {
+		ids = append(ids, s.idWith(key, app_token))
+	}
+	return append(ids, app_token)
+}
+
+// Whether the id is a plaintext app token, stored by an older release.
+func isLegacyID(id string) bool {
+	return !strings.HasPrefix(id, hashPrefix)
+}
+
+// Whether the Copilot token is encrypted with the current key, or empty.
+func (s *sealer) isCurrent(sealed string) bool {
+	return sealed == "" || strings.HasPrefix(sealed, sealedPrefix+s.keys[0].id+":")
+}
+
+// Encrypt the Copilot token of the item stored under the id with the current key.
+func (s *sealer) seal(id string, c_token string) string {
+	if c_token == "" {
+		return ""
+	}
+	key := s.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(c_token), []byte(id))
+	return sealedPrefix + key.id + ":" + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// Decrypt the Copilot token of the item stored under the id. Plaintext Copilot tokens
+// of older releases are returned as they are.
+func (s *sealer) open(id string, sealed string) (string, error) {
+	value, ok := strings.CutPrefix(sealed, sealedPrefix)
+	if !ok {
+		return sealed, nil
+	}
+	keyID, value, _ := strings.Cut(value, ":")
+	key, ok := s.byID[keyID]
+	if !ok {
+		return "", fmt.Errorf("the cache key %s is not configured", keyID)
+	}
+	data, err := base64.RawStdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < key.aead.NonceSize() {
+		return "", errors.New("the encrypted Copilot token is too short")
+	}
+	nonceSize := key.aead.NonceSize()
+	plaintext, err := key.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Seal the item of an app token to be stored under the id.
+func (s *sealer) sealItem(id string, item Authorization) Authorization {
+	item.App_token = id
+	item.C_token = s.seal(id, item.C_token)
+	return item
+}
+
+// Open a stored item for its app token.
+func (s *sealer) openItem(app_token string, item Authorization) (Authorization, error) {
+	c_token, err := s.open(item.App_token, item.C_token)
+	if err != nil {
+		return Authorization{}, err
+	}
+	item.App_token = app_token
+	item.C_token = c_token
+	return item, nil
+}
+
+// Load the cache keys from keys, base64 encoded and separated by ',', or else from the key
+// file, one per line. The first key is the current one. If create is set, a missing key
+// file is created with a new random key.
+func loadKeys(keys string, keyFile string, create bool) ([][]byte, error) {
+	var lines []string
+	if keys != "" {
+		lines = strings.Split(keys, ",")
+	} else if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if os.IsNotExist(err) && create {
+			return createKeyFile(keyFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = strings.Split(string(data), "\n")
+	} else {
+		return nil, errors.New("neither CACHE_KEY nor CACHE_KEY_FILE is set")
+	}
+
+	secrets := make([][]byte, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secret, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache key, expected base64: %w", err)
+		}
+		secrets = append(secrets, secret)
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("no cache key found")
+	}
+	return secrets, nil
+}
+
+// Create the key file with a new random key, readable by the owner only.
+func createKeyFile(keyFile string) ([][]byte, error) {
+	secret := make([]byte, keyLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := tools.MkdirAllIfNotExists(keyFile, os.ModePerm); err != nil {
+		return nil, err
+	}
+	content := "# Key of the cache, keep it apart from the cache database. To rotate it, add a new key\n" +
+		"# as the first line and keep the former keys below: an item moves to the new key when its\n" +
+		"# GitHub token is used next. Once a former key is removed, the items still stored with it\n" +
+		"# are lost and their tokens are exchanged again, which is harmless once their Copilot\n" +
+		"# tokens have expired, about 30 minutes after the restart.\n" +
+		base64.StdEncoding.EncodeToString(secret) + "\n"
+	if err := os.WriteFile(keyFile, []byte(content), 0600); err != nil {
+		return nil, err
+	}
+	log.ZLog.Log.Warn().Msg("Created the cache key file " + keyFile + ", keep it safe: the cached tokens can not be read without it.")
+	return [][]byte{secret}, nil
+}
@@ -0,0 +1,66 @@
+package cache
+
+import "sync"
+
+// memoryStore keeps the cache in memory, it is lost when the service stops. It is safe
+// for concurrent use, every read-modify-write of an item happens under its lock.
+type memoryStore struct {
+	mu    sync.RWMutex
+	items map[string]Authorization
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{items: make(map[string]Authorization)}
+}
+
+func (s *memoryStore) Get(app_token string) (Authorization, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, ok := s.items[app_token]
+	return item, ok, nil
+}
+
+func (s *memoryStore) Update(app_token string, fn func(item *Authorization, exists bool) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, exists := s.items[app_token]
+	if !fn(&item, exists) {
+		return false, nil
+	}
+	s.items[app_token] = item
+	return true, nil
+}
+
+func (s *memoryStore) Delete(app_token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, app_token)
+	return nil
+}
+
+func (s *memoryStore) DeleteUntouched(before int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := make([]string, 0)
+	for app_token, item := range s.items {
+		if item.Last_touched < before {
+			delete(s.items, app_token)
+			removed = append(removed, app_token)
+		}
+	}
+	return removed, nil
+}
+
+func (s *memoryStore) List() ([]Authorization, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]Authorization, 0, len(s.items))
+	for _, item := range s.items {
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Keys of the cache in Redis: an item per app token and a sorted set of the app tokens
+// scored by the time they were last touched, to find the items to clean.
+const (
+	redisItemPrefix = "copilot-gpt4-service:cache:item:"
+	redisTouchedKey = "copilot-gpt4-service:cache:touched"
+)
+
+// How often an update is retried, after a random delay, when the item is changed concurrently,
+// e.g. by another replica.
+const redisUpdateRetries = 10
+
+// Delete the items touched before ARGV[1] and return their app tokens.
+var redisDeleteUntouched = redis.NewScript(`
+local tokens = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+for _, token in ipairs(tokens) do
+	redis.call('DEL', ARGV[2] .. token)
+	redis.call('ZREM', KEYS[1], token)
+end
+return tokens
+`)
+
+// redisStore keeps the cache in Redis, or a server speaking its protocol, so that
+// several replicas of the service share the Copilot tokens and the sessions.
+type redisStore struct {
+	client *redis.Client
+}
+
+// Connect to the Redis server at the URL.
+func openRedisStore(url string) (*redisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisStore{client: client}, nil
+}
+
+func getRedisItem(ctx context.Context, client redis.Cmdable, app_token string) (Authorization, bool, error) {
+	data, err := client.Get(ctx, redisItemPrefix+app_token).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Authorization{}, false, nil
+	}
+	if err != nil {
+		return Authorization{}, false, err
+	}
+	var item Authorization
+	if err := json.Unmarshal(data, &item); err != nil {
+		return Authorization{}, false, err
+	}
+	return item, true, nil
+}
+
+func (s *redisStore) Get(app_token string) (Authorization, bool, error) {
+	return getRedisItem(context.Background(), s.client, app_token)
+}
+
+// The item is watched while fn runs, the update is retried if the item changed in between.
+func (s *redisStore) Update(app_token string, fn func(item *Authorization, exists bool) bool) (bool, error) {
+	ctx := context.Background()
+	key := redisItemPrefix + app_token
+	stored := false
+	update := func(tx *redis.Tx) error {
+		item, exists, err := getRedisItem(ctx, tx, app_token)
+		if err != nil {
+			return err
+		}
+		if stored = fn(&item, exists); !stored {
+			return nil
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			pipe.ZAdd(ctx, redisTouchedKey, redis.Z{Score: float64(item.Last_touched), Member: app_token})
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < redisUpdateRetries; i++ {
+		err := s.client.Watch(ctx, update, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			time.Sleep(time.Duration(rand.Intn(10*(i+1))) * time.Millisecond)
+			continue
+		}
+		return stored && err == nil, err
+	}
+	return false, errors.New("the cache item is changed concurrently too often, app_token: " + app_token)
+}
+
+func (s *redisStore) Delete(app_token string) error {
+	ctx := context.Background()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisItemPrefix+app_token)
+		pipe.ZRem(ctx, redisTouchedKey, app_token)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) DeleteUntouched(before int64) ([]string, error) {
+	return redisDeleteUntouched.Run(context.Background(), s.client, []string{redisTouchedKey}, before, redisItemPrefix).StringSlice()
+}
+
+func (s *redisStore) List() ([]Authorization, error) {
+	ctx := context.Background()
+	tokens, err := s.client.ZRange(ctx, redisTouchedKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Authorization, 0, len(tokens))
+	for _, token := range tokens {
+		item, ok, err := getRedisItem(ctx, s.client, token)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
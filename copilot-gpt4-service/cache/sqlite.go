@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"copilot-gpt4-service/log"
+	"copilot-gpt4-service/migrate"
+	"copilot-gpt4-service/tools"
+	"database/sql"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore keeps the cache in a sqlite database, the other tables of the service live
+// there as well. Only this process writes to the database, the read-modify-writes of the
+// items are serialized by a lock.
+type sqliteStore struct {
+	mu sync.Mutex
+	db *sqlx.DB
+}
+
+// OpenDB connects to the sqlite database at the path, creating its directory if needed.
+// The schema is left as it is, see migrate.
+func OpenDB(cache_path string) (*sqlx.DB, error) {
+	// create cache directory if not exists
+	if err := tools.MkdirAllIfNotExists(cache_path, os.ModePerm); err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Create cache directory failed, cache_path: " + cache_path + ". Please check the configuration file.")
+		return nil, err
+	}
+
+	// connect to database, concurrent writers wait for each other instead of failing,
+	// and deleted items are overwritten so that no token is left in the file
+	db, err := sqlx.Connect("sqlite", cache_path+"?_pragma=busy_timeout(5000)&_pragma=secure_delete(1)")
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Connect to database failed. Please check cache database path, cache_path: " + cache_path)
+		return nil, err
+	}
+	return db, nil
+}
+
+// Connect to the database at the path and apply the pending migrations.
+func openSQLiteStore(cache_path string) (*sqliteStore, error) {
+	db, err := OpenDB(cache_path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = migrate.Up(db, false); err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Migrate cache database failed, cache_path: " + cache_path)
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Get(app_token string) (Authorization, bool, error) {
+	var authorization Authorization
+	err := s.db.Get(&authorization, "SELECT * FROM cache WHERE app_token = ?", app_token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Authorization{}, false, nil
+	}
+	if err != nil {
+		return Authorization{}, false, err
+	}
+	return authorization, true, nil
+}
+
+func (s *sqliteStore) Update(app_token string, fn func(item *Authorization, exists bool) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, exists, err := s.Get(app_token)
+	if err != nil {
+		return false, err
+	}
+	if !fn(&item, exists) {
+		return false, nil
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO cache (app_token, c_token, expires_at, vscode_machineid, vscode_sessionid, session_expires_at, last_touched)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(app_token) DO UPDATE SET c_token = excluded.c_token, expires_at = excluded.expires_at,
+			vscode_machineid = excluded.vscode_machineid, vscode_sessionid = excluded.vscode_sessionid,
+			session_expires_at = excluded.session_expires_at, last_touched = excluded.last_touched
+	`, app_token, item.C_token, item.ExpiresAt, item.Vscode_machineid, item.Vscode_sessionid, item.Session_expires_at, item.Last_touched)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *sqliteStore) Delete(app_token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.db.Exec("DELETE FROM cache WHERE app_token = ?", app_token)
+	return err
+}
+
+func (s *sqliteStore) DeleteUntouched(before int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := make([]string, 0)
+	if err := s.db.Select(&removed, "SELECT app_token FROM cache WHERE last_touched < ?", before); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.Exec("DELETE FROM cache WHERE last_touched < ?", before); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (s *sqliteStore) List() ([]Authorization, error) {
+	items := make([]Authorization, 0)
+	err := s.db.Select(&items, "SELECT * FROM cache")
+	return items, err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,472 @@
+// Package fakeupstream emulates the GitHub token exchange and the GitHub Copilot
+// API, so that the service can be run and tested without GitHub.
+package fakeupstream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"copilot-gpt4-service/openai"
+)
+
+// Paths of the emulated endpoints, relative to the base URLs of the GitHub API and the Copilot API.
+const (
+	EndpointToken           = "/copilot_internal/v2/token"
+	EndpointChatCompletions = "/chat/completions"
+	EndpointEmbeddings      = "/embeddings"
+	EndpointModels          = "/models"
+)
+
+// TokenPrefix starts every Copilot token issued by the fake upstream.
+const TokenPrefix = "fake-copilot-token"
+
+// EmbeddingDimensions is the length of the embeddings returned by the fake upstream.
+const EmbeddingDimensions = 16
+
+// A request containing fake_status=NNN, e.g. in the last message, is answered with that status
+// unless a reply is scripted. This allows to try the error handling from any client.
+var statusDirective = regexp.MustCompile(`fake_status=(\d{3})`)
+
+// Reply is a scripted answer of an endpoint.
+type Reply struct {
+	// Status of the reply, 200 if not set.
+	Status int
+	// Body of an error reply, the status text if empty. For the token exchange
+	// and successful replies the body is generated, unless Body is set.
+	Body string
+	// Headers of an error reply, e.g. Retry-After.
+	Header http.Header
+	// Content of the assistant message of a chat completion.
+	Content string
+	// Tool calls of the assistant message of a chat completion.
+	ToolCalls []openai.ToolCall
+	// Delay before the reply and, when streaming, between the chunks.
+	Delay time.Duration
+	// Message of an error event that ends a stream after the content, as upstream
+	// reports the failures after the response started.
+	StreamError string
+	// Cut the connection off after the content of a stream, before it is finished.
+	StreamAbort bool
+	// Close the connection without a reply, as a connection reset.
+	Drop bool
+}
+
+// Server is the fake upstream. Replies scripted with Enqueue are used first, in order,
+// then every endpoint answers with its default reply.
+type Server struct {
+	mu         sync.Mutex
+	scripts    map[string][]Reply
+	calls      map[string]int
+	aborted    int
+	requests   map[string][]byte
+	accounts   map[string]bool
+	generation int
+	issued     int
+	tokenTTL   time.Duration
+}
+
+// Create a new Server instance.
+func New() *Server {
+	return &Server{
+		scripts:    make(map[string][]Reply),
+		calls:      make(map[string]int),
+		requests:   make(map[string][]byte),
+		accounts:   make(map[string]bool),
+		generation: 1,
+		tokenTTL:   30 * time.Minute,
+	}
+}
+
+// Listen on the address and serve in the background. The base URL of the server is returned,
+// it serves both as base URL of the GitHub API and of the Copilot API.
+func (s *Server) Listen(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(listener, s)
+	return "http://" + listener.Addr().String(), nil
+}
+
+// Script the next replies of the endpoint.
+func (s *Server) Enqueue(endpoint string, replies ...Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[endpoint] = append(s.scripts[endpoint], replies...)
+}
+
+// Calls returns the number of requests the endpoint received.
+func (s *Server) Calls(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[endpoint]
+}
+
+// Aborted returns the number of chat completion streams left by their client before they finished.
+func (s *Server) Aborted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.aborted
+}
+
+// LastRequest returns the body of the last request the endpoint received.
+func (s *Server) LastRequest(endpoint string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// Only exchange the given GitHub Copilot Plugin Tokens, the others are answered with 401.
+// Every token is exchanged if none is set.
+func (s *Server) SetAccounts(tokens ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts = make(map[string]bool)
+	for _, token := range tokens {
+		s.accounts[token] = true
+	}
+}
+
+// Set the lifetime of the issued Copilot tokens.
+func (s *Server) SetTokenTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenTTL = ttl
+}
+
+// Invalidate every Copilot token issued so far, they are answered with 401 from now on.
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+}
+
+// Count the call and take the next scripted reply of the endpoint, if any.
+func (s *Server) next(endpoint string, body []byte) (Reply, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[endpoint]++
+	s.requests[endpoint] = body
+	replies := s.scripts[endpoint]
+	if len(replies) == 0 {
+		return Reply{}, false
+	}
+	s.scripts[endpoint] = replies[1:]
+	return replies[0], true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case EndpointToken:
+		s.token(w, r)
+	case EndpointChatCompletions:
+		s.chatCompletions(w, r)
+	case EndpointEmbeddings:
+		s.embeddings(w, r)
+	case EndpointModels:
+		s.models(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Write an error reply, return false if the reply is successful and still to be written.
+func writeError(w http.ResponseWriter, reply Reply) bool {
+	if reply.Status == 0 || reply.Status == http.StatusOK {
+		return false
+	}
+	body := reply.Body
+	if body == "" {
+		body = fmt.Sprintf(`{"error":{"message":%q}}`, http.StatusText(reply.Status))
+	}
+	for key, values := range reply.Header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(reply.Status)
+	_, _ = w.Write([]byte(body))
+	return true
+}
+
+// Read the request body and fill the reply: the scripted one if any, otherwise the
+// status of a fake_status directive in the body.
+func (s *Server) reply(endpoint string, r *http.Request) (Reply, []byte) {
+	body, _ := io.ReadAll(r.Body)
+	reply, scripted := s.next(endpoint, body)
+	if !scripted {
+		if match := statusDirective.FindSubmatch(body); match != nil {
+			reply.Status, _ = strconv.Atoi(string(match[1]))
+		}
+	}
+	time.Sleep(reply.Delay)
+	if reply.Drop {
+		panic(http.ErrAbortHandler)
+	}
+	return reply, body
+}
+
+// Whether the request carries a Copilot token that is still valid.
+func (s *Server) authorized(r *http.Request) bool {
+	s.mu.Lock()
+	prefix := fmt.Sprintf("Bearer %s-%d-", TokenPrefix, s.generation)
+	s.mu.Unlock()
+	return strings.HasPrefix(r.Header.Get("Authorization"), prefix)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	reply, _ := s.reply(EndpointToken, r)
+	account, ok := strings.CutPrefix(r.Header.Get("Authorization"), "token ")
+	s.mu.Lock()
+	if !ok || account == "" || (len(s.accounts) > 0 && !s.accounts[account]) {
+		reply.Status = http.StatusUnauthorized
+	}
+	s.mu.Unlock()
+	if writeError(w, reply) {
+		return
+	}
+
+	s.mu.Lock()
+	s.issued++
+	token := fmt.Sprintf("%s-%d-%d", TokenPrefix, s.generation, s.issued)
+	expiresAt := time.Now().Add(s.tokenTTL).Unix()
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if reply.Body != "" {
+		_, _ = w.Write([]byte(reply.Body))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": expiresAt,
+		"refresh_in": int64(s.tokenTTL.Seconds()) / 2,
+	})
+}
+
+func (s *Server) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	reply, body := s.reply(EndpointChatCompletions, r)
+	if !s.authorized(r) {
+		reply.Status = http.StatusUnauthorized
+	}
+	if writeError(w, reply) {
+		return
+	}
+
+	var request struct {
+		Model    string `json:"model"`
+		Stream   bool   `json:"stream"`
+		Messages []struct {
+			Content interface{} `json:"content"`
+		} `json:"messages"`
+	}
+	_ = json.Unmarshal(body, &request)
+	if reply.Body != "" {
+		_, _ = w.Write([]byte(reply.Body))
+		return
+	}
+	content := reply.Content
+	if content == "" && len(reply.ToolCalls) == 0 {
+		last := ""
+		if len(request.Messages) > 0 {
+			last = fmt.Sprint(request.Messages[len(request.Messages)-1].Content)
+		}
+		content = "This is a fake reply to: " + last
+	}
+
+	id := fmt.Sprintf("chatcmpl-fake%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+	finishReason := "stop"
+	if len(reply.ToolCalls) > 0 {
+		finishReason = "tool_calls"
+	}
+
+	if !request.Stream {
+		message := map[string]interface{}{"role": "assistant", "content": content}
+		if len(reply.ToolCalls) > 0 {
+			message["tool_calls"] = reply.ToolCalls
+			if content == "" {
+				message["content"] = nil
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      id,
+			"created": created,
+			"model":   request.Model,
+			"choices": []interface{}{map[string]interface{}{
+				"index":         0,
+				"message":       message,
+				"finish_reason": finishReason,
+			}},
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	writeChunk := func(chunk interface{}) {
+		data, _ := json.Marshal(chunk)
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	choice := func(delta map[string]interface{}, finishReason interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"id":      id,
+			"created": created,
+			"model":   request.Model,
+			"choices": []interface{}{map[string]interface{}{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": finishReason,
+			}},
+		}
+	}
+
+	// Copilot starts the stream with the prompt filter results, without choices
+	writeChunk(map[string]interface{}{"choices": []interface{}{}, "prompt_filter_results": []interface{}{}})
+	role := "assistant"
+	for i, word := range strings.SplitAfter(content, " ") {
+		if word == "" {
+			continue
+		}
+		if i > 0 {
+			time.Sleep(reply.Delay)
+		}
+		if r.Context().Err() != nil {
+			s.mu.Lock()
+			s.aborted++
+			s.mu.Unlock()
+			return
+		}
+		delta := map[string]interface{}{"content": word}
+		if role != "" {
+			delta["role"] = role
+			role = ""
+		}
+		writeChunk(choice(delta, nil))
+	}
+	for i, call := range reply.ToolCalls {
+		index := i
+		call.Index = &index
+		delta := map[string]interface{}{"tool_calls": []openai.ToolCall{call}}
+		if role != "" {
+			delta["role"] = role
+			role = ""
+		}
+		writeChunk(choice(delta, nil))
+	}
+	if reply.StreamAbort {
+		panic(http.ErrAbortHandler)
+	}
+	if reply.StreamError != "" {
+		writeChunk(map[string]interface{}{"error": map[string]interface{}{"message": reply.StreamError, "code": "upstream_error"}})
+		_, _ = w.Write([]byte("data: [DONE]\n\n"))
+		return
+	}
+	writeChunk(choice(map[string]interface{}{}, finishReason))
+	_, _ = w.Write([]byte("data: [DONE]\n\n"))
+}
+
+func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
+	reply, body := s.reply(EndpointEmbeddings, r)
+	if !s.authorized(r) {
+		reply.Status = http.StatusUnauthorized
+	}
+	if writeError(w, reply) {
+		return
+	}
+	if reply.Body != "" {
+		_, _ = w.Write([]byte(reply.Body))
+		return
+	}
+
+	var request struct {
+		Model string        `json:"model"`
+		Input []interface{} `json:"input"`
+	}
+	_ = json.Unmarshal(body, &request)
+	data := make([]interface{}, 0, len(request.Input))
+	for i, input := range request.Input {
+		data = append(data, map[string]interface{}{
+			"index":     i,
+			"embedding": embedding(fmt.Sprint(input)),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"model": request.Model,
+		"data":  data,
+	})
+}
+
+// Models of the catalog, in the format of the GitHub Copilot API.
+var catalog = []map[string]interface{}{
+	catalogEntry("gpt-4o", "GPT-4o", "chat", 128000, true),
+	catalogEntry("gpt-4o-mini", "GPT-4o mini", "chat", 128000, true),
+	catalogEntry("gpt-4", "GPT 4", "chat", 32768, false),
+	catalogEntry("text-embedding-3-small", "Embedding V3 small", "embeddings", 8191, false),
+}
+
+func catalogEntry(id string, name string, kind string, contextWindow int, vision bool) map[string]interface{} {
+	limits := map[string]interface{}{"max_context_window_tokens": contextWindow}
+	supports := map[string]interface{}{}
+	if kind == "chat" {
+		limits["max_output_tokens"] = 4096
+		supports["streaming"] = true
+		supports["tool_calls"] = true
+		supports["vision"] = vision
+	}
+	return map[string]interface{}{
+		"id":      id,
+		"name":    name,
+		"object":  "model",
+		"vendor":  "Azure OpenAI",
+		"version": id,
+		"capabilities": map[string]interface{}{
+			"type":     kind,
+			"limits":   limits,
+			"supports": supports,
+		},
+	}
+}
+
+func (s *Server) models(w http.ResponseWriter, r *http.Request) {
+	reply, _ := s.reply(EndpointModels, r)
+	if !s.authorized(r) {
+		reply.Status = http.StatusUnauthorized
+	}
+	if writeError(w, reply) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if reply.Body != "" {
+		_, _ = w.Write([]byte(reply.Body))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   catalog,
+	})
+}
+
+// A deterministic embedding of the input, derived from its hash.
+func embedding(input string) []float64 {
+	sum := sha256.Sum256([]byte(input))
+	vector := make([]float64, EmbeddingDimensions)
+	for i := range vector {
+		vector[i] = float64(binary.BigEndian.Uint16(sum[i*2:]))/65535*2 - 1
+	}
+	return vector
+}
@@ -0,0 +1,117 @@
+package fakeupstream
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Start the fake upstream and return it with an authorized Copilot token.
+func start(t *testing.T) (*Server, string, string) {
+	t.Helper()
+	fake := New()
+	upstream := httptest.NewServer(fake)
+	t.Cleanup(upstream.Close)
+
+	request, _ := http.NewRequest("GET", upstream.URL+EndpointToken, nil)
+	request.Header.Set("Authorization", "token ghu_test")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil || !strings.HasPrefix(reply.Token, TokenPrefix) {
+		t.Fatalf("unexpected token reply: %v %q", err, reply.Token)
+	}
+	return fake, upstream.URL, reply.Token
+}
+
+func post(t *testing.T, url string, token string, body string) (*http.Response, error) {
+	t.Helper()
+	request, _ := http.NewRequest("POST", url+EndpointChatCompletions, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(request)
+}
+
+func TestScriptedFailures(t *testing.T) {
+	fake, url, token := start(t)
+	fake.Enqueue(EndpointChatCompletions,
+		Reply{Status: http.StatusServiceUnavailable},
+		Reply{Status: http.StatusTooManyRequests, Body: `{"error":{"message":"slow down"}}`},
+		Reply{Drop: true},
+	)
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+
+	resp, err := post(t, url, token, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the scripted 503, got %d", resp.StatusCode)
+	}
+
+	resp, err = post(t, url, token, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(string(data), "slow down") {
+		t.Fatalf("expected the scripted 429 with its body, got %d %s", resp.StatusCode, data)
+	}
+
+	if resp, err = post(t, url, token, body); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the dropped connection to fail, got %d", resp.StatusCode)
+	}
+
+	// the script is used up, the default reply follows
+	resp, err = post(t, url, token, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(data), "This is a fake reply to: hi") {
+		t.Fatalf("unexpected default reply: %d %s", resp.StatusCode, data)
+	}
+	if calls := fake.Calls(EndpointChatCompletions); calls != 4 {
+		t.Fatalf("expected 4 calls, got %d", calls)
+	}
+}
+
+func TestStatusDirective(t *testing.T) {
+	_, url, token := start(t)
+	resp, err := post(t, url, token, `{"messages":[{"role":"user","content":"fake_status=502"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected the status of the directive, got %d", resp.StatusCode)
+	}
+}
+
+func TestLastRequest(t *testing.T) {
+	fake, url, token := start(t)
+	if body := fake.LastRequest(EndpointChatCompletions); body != nil {
+		t.Fatalf("unexpected request before any call: %s", body)
+	}
+	for _, body := range []string{`{"messages":[],"seed":1}`, `{"messages":[],"seed":2}`} {
+		resp, err := post(t, url, token, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if body := string(fake.LastRequest(EndpointChatCompletions)); body != `{"messages":[],"seed":2}` {
+		t.Fatalf("unexpected last request: %s", body)
+	}
+}
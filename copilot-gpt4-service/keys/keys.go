@@ -0,0 +1,274 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"copilot-gpt4-service/cache"
+	"copilot-gpt4-service/log"
+	"copilot-gpt4-service/tools"
+)
+
+// SecretPrefix marks the API keys issued by this service, so that they can be
+// told apart from GitHub Copilot Plugin Tokens in the Authorization header.
+const SecretPrefix = "sk-cgs-"
+
+var (
+	ErrNotFound = errors.New("api key not found")
+	ErrRevoked  = errors.New("api key has been revoked")
+	ErrExpired  = errors.New("api key has expired")
+)
+
+// StoreInstance is a global variable that is used to access the API keys, created by the
+// service once the configuration is loaded.
+var StoreInstance *Store
+
+// List is a list of strings stored as a comma separated column.
+type List []string
+
+func (l *List) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+	default:
+		return errors.New("keys: unsupported list column type")
+	}
+	*l = List{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (l List) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+// Whether the value matches one of the patterns. An empty list allows everything,
+// a pattern ending with '*' matches every value with that prefix.
+func (l List) allows(value string) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, pattern := range l {
+		if pattern == value || pattern == "*" ||
+			(strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key is an API key issued by this service. Only the hash of the secret is stored.
+type Key struct {
+	ID         string `db:"id" json:"id"`
+	Name       string `db:"name" json:"name"`
+	Hash       string `db:"key_hash" json:"-"`
+	Prefix     string `db:"key_prefix" json:"prefix"`
+	Endpoints  List   `db:"endpoints" json:"endpoints"`
+	Models     List   `db:"models" json:"models"`
+	CreatedAt  int64  `db:"created_at" json:"created_at"`
+	LastUsedAt int64  `db:"last_used_at" json:"last_used_at"`
+	ExpiresAt  int64  `db:"expires_at" json:"expires_at"`
+	RevokedAt  int64  `db:"revoked_at" json:"revoked_at"`
+}
+
+// Whether the key may call the endpoint, e.g. /v1/chat/completions.
+func (k *Key) AllowsEndpoint(path string) bool {
+	return k.Endpoints.allows(path)
+}
+
+// Whether the key may use the model.
+func (k *Key) AllowsModel(model string) bool {
+	return k.Models.allows(model)
+}
+
+// Store keeps the API keys in the cache database.
+type Store struct {
+	mu    sync.Mutex
+	cache *cache.Cache
+	Db    *sqlx.DB
+}
+
+// Create a new Store instance.
+func NewStore(c *cache.Cache) *Store {
+	return &Store{cache: c}
+}
+
+// Connect to the cache database, the table is created by its migrations.
+func (s *Store) connect() (*sqlx.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Db != nil {
+		return s.Db, nil
+	}
+
+	db, err := s.cache.DB()
+	if err != nil {
+		return nil, err
+	}
+	s.Db = db
+	return s.Db, nil
+}
+
+// Hash the secret of an API key.
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a new secret, return it together with its hash and display prefix.
+func newSecret() (string, string, string) {
+	secret := SecretPrefix + tools.GenHexStr(48)
+	return secret, hash(secret), secret[:len(SecretPrefix)+4]
+}
+
+// Create a new key, the secret is returned only this time.
+func (s *Store) Create(name string, endpoints []string, models []string, expiresAt int64) (*Key, string, error) {
+	db, err := s.connect()
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, secretHash, prefix := newSecret()
+	key := &Key{
+		ID:        "key-" + tools.GenHexStr(16),
+		Name:      name,
+		Hash:      secretHash,
+		Prefix:    prefix,
+		Endpoints: append(List{}, endpoints...),
+		Models:    append(List{}, models...),
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: expiresAt,
+	}
+	_, err = db.NamedExec(`INSERT INTO api_keys (id, name, key_hash, key_prefix, endpoints, models, created_at, last_used_at, expires_at, revoked_at)
+		VALUES (:id, :name, :key_hash, :key_prefix, :endpoints, :models, :created_at, :last_used_at, :expires_at, :revoked_at)`, key)
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Insert api key failed, name: " + name)
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// List all keys, including the revoked ones.
+func (s *Store) List() ([]Key, error) {
+	db, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]Key, 0)
+	if err := db.Select(&keys, "SELECT * FROM api_keys ORDER BY created_at"); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Get the key by its ID.
+func (s *Store) Get(id string) (*Key, error) {
+	db, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	var key Key
+	if err := db.Get(&key, "SELECT * FROM api_keys WHERE id = ?", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+// Replace the secret of the key, keeping its settings. The new secret is returned only this time.
+func (s *Store) Rotate(id string) (*Key, string, error) {
+	key, err := s.Get(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if key.RevokedAt != 0 {
+		return nil, "", ErrRevoked
+	}
+
+	db, err := s.connect()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, secretHash, prefix := newSecret()
+	if _, err := db.Exec("UPDATE api_keys SET key_hash = ?, key_prefix = ? WHERE id = ?", secretHash, prefix, id); err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Rotate api key failed, id: " + id)
+		return nil, "", err
+	}
+	key.Hash = secretHash
+	key.Prefix = prefix
+	return key, secret, nil
+}
+
+// Revoke the key, it can not be used anymore.
+func (s *Store) Revoke(id string) (*Key, error) {
+	key, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt == 0 {
+		db, err := s.connect()
+		if err != nil {
+			return nil, err
+		}
+		key.RevokedAt = time.Now().Unix()
+		if _, err := db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ?", key.RevokedAt, id); err != nil {
+			log.ZLog.Log.Error().Err(err).Msg("Revoke api key failed, id: " + id)
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// The last use of a key is recorded at most once within this many seconds, so that not every
+// request writes to the database.
+const lastUsedInterval = 60
+
+// Lookup the key of a secret and record its use. Revoked and expired keys are rejected.
+func (s *Store) Lookup(secret string) (*Key, error) {
+	db, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	var key Key
+	if err := db.Get(&key, "SELECT * FROM api_keys WHERE key_hash = ?", hash(secret)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if key.RevokedAt != 0 {
+		return nil, ErrRevoked
+	}
+	if key.ExpiresAt != 0 && key.ExpiresAt <= now {
+		return nil, ErrExpired
+	}
+
+	if now-key.LastUsedAt < lastUsedInterval {
+		return &key, nil
+	}
+	key.LastUsedAt = now
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now, key.ID); err != nil {
+		log.ZLog.Log.Warn().Err(err).Msg("Update api key last_used_at failed, id: " + key.ID)
+	}
+	return &key, nil
+}
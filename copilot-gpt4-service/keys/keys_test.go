@@ -0,0 +1,194 @@
+package keys
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"copilot-gpt4-service/cache"
+	"copilot-gpt4-service/log"
+)
+
+const testKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+func newStore(t *testing.T) *Store {
+	t.Helper()
+	c := cache.NewCache("sqlite://"+t.TempDir()+"/cache.sqlite3", testKey, "")
+	t.Cleanup(c.Close)
+	return NewStore(c)
+}
+
+func TestCreateAndLookup(t *testing.T) {
+	s := newStore(t)
+	key, secret, err := s.Create("ci", []string{"/v1/chat/completions"}, []string{"gpt-4*"}, 0)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.HasPrefix(secret, SecretPrefix) || !strings.HasPrefix(secret, key.Prefix) || len(key.Prefix) != len(SecretPrefix)+4 {
+		t.Fatalf("unexpected secret %q with prefix %q", secret, key.Prefix)
+	}
+
+	stored, err := s.Get(key.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if stored.Hash != hash(secret) || strings.Contains(stored.Hash, secret) {
+		t.Fatalf("the secret is not stored as its hash: %q", stored.Hash)
+	}
+	if stored.Name != "ci" || len(stored.Endpoints) != 1 || len(stored.Models) != 1 {
+		t.Fatalf("unexpected key: %+v", stored)
+	}
+
+	found, err := s.Lookup(secret)
+	if err != nil || found.ID != key.ID {
+		t.Fatalf("lookup: %+v, %v", found, err)
+	}
+	if found.LastUsedAt == 0 {
+		t.Fatal("last use not recorded")
+	}
+	if stored, _ := s.Get(key.ID); stored.LastUsedAt != found.LastUsedAt {
+		t.Fatalf("last use not stored: %d", stored.LastUsedAt)
+	}
+
+	// the last use is not written again within the interval
+	s.Db.MustExec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", found.LastUsedAt-lastUsedInterval/2, key.ID)
+	if again, err := s.Lookup(secret); err != nil || again.LastUsedAt != found.LastUsedAt-lastUsedInterval/2 {
+		t.Fatalf("last use written within the interval: %+v, %v", again, err)
+	}
+	s.Db.MustExec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", found.LastUsedAt-lastUsedInterval, key.ID)
+	if again, err := s.Lookup(secret); err != nil || again.LastUsedAt < found.LastUsedAt {
+		t.Fatalf("last use not written after the interval: %+v, %v", again, err)
+	}
+
+	if _, err := s.Lookup(secret + "x"); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Get("key-missing"); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := newStore(t)
+	_, expired, err := s.Create("expired", nil, nil, time.Now().Add(-time.Second).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lookup(expired); err != ErrExpired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, valid, err := s.Create("valid", nil, nil, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lookup(valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	s := newStore(t)
+	key, secret, err := s.Create("revoked", nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := s.Revoke(key.ID)
+	if err != nil || revoked.RevokedAt == 0 {
+		t.Fatalf("revoke: %+v, %v", revoked, err)
+	}
+	if again, err := s.Revoke(key.ID); err != nil || again.RevokedAt != revoked.RevokedAt {
+		t.Fatalf("revoke again: %+v, %v", again, err)
+	}
+	if _, err := s.Lookup(secret); err != ErrRevoked {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := s.Rotate(key.ID); err != ErrRevoked {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Revoke("key-missing"); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	s := newStore(t)
+	key, old, err := s.Create("rotated", []string{"/v1/embeddings"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, secret, err := s.Rotate(key.ID)
+	if err != nil || secret == old || rotated.ID != key.ID {
+		t.Fatalf("rotate: %+v, %v", rotated, err)
+	}
+	if _, err := s.Lookup(old); err != ErrNotFound {
+		t.Fatalf("the former secret still works: %v", err)
+	}
+	found, err := s.Lookup(secret)
+	if err != nil || found.ID != key.ID || !found.AllowsEndpoint("/v1/embeddings") {
+		t.Fatalf("lookup: %+v, %v", found, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	s := newStore(t)
+	for _, name := range []string{"a", "b"} {
+		if _, _, err := s.Create(name, nil, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := s.List()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("list: %+v, %v", keys, err)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	key := Key{
+		Endpoints: List{"/v1/chat/completions"},
+		Models:    List{"gpt-4*", "claude-3.5-sonnet"},
+	}
+	if !key.AllowsEndpoint("/v1/chat/completions") || key.AllowsEndpoint("/v1/embeddings") {
+		t.Fatal("unexpected endpoint scope")
+	}
+	for model, want := range map[string]bool{
+		"gpt-4":             true,
+		"gpt-4o":            true,
+		"claude-3.5-sonnet": true,
+		"claude-3.7-sonnet": false,
+		"gpt-3.5-turbo":     false,
+	} {
+		if got := key.AllowsModel(model); got != want {
+			t.Errorf("AllowsModel(%q) = %v, want %v", model, got, want)
+		}
+	}
+	unscoped := Key{}
+	if !unscoped.AllowsEndpoint("/anything") || !unscoped.AllowsModel("anything") {
+		t.Fatal("an empty scope should allow everything")
+	}
+	if wildcard := (Key{Models: List{"*"}}); !wildcard.AllowsModel("o1") {
+		t.Fatal("* should allow every model")
+	}
+}
+
+func TestListColumn(t *testing.T) {
+	var l List
+	if err := l.Scan(" a, ,b "); err != nil || len(l) != 2 || l[0] != "a" || l[1] != "b" {
+		t.Fatalf("scan: %q, %v", l, err)
+	}
+	if err := l.Scan(nil); err != nil || len(l) != 0 {
+		t.Fatalf("scan nil: %q, %v", l, err)
+	}
+	if err := l.Scan(1); err == nil {
+		t.Fatal("scan of a number should fail")
+	}
+	if value, err := (List{"a", "b"}).Value(); err != nil || value != "a,b" {
+		t.Fatalf("value: %v, %v", value, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/rs/zerolog"
 	"gopkg.in/natefinch/lumberjack.v2"
 
+	"io"
 	"os"
 
 	"copilot-gpt4-service/config"
@@ -13,6 +14,11 @@ type Logger struct {
 	Log zerolog.Logger
 }
 
+// Create a logger writing to w, the secrets are masked by RedactorInstance.
+func New(w io.Writer) *Logger {
+	return &Logger{Log: zerolog.New(RedactorInstance.Writer(w)).With().Timestamp().Logger()}
+}
+
 func NewLogger() *Logger {
 	logger := &lumberjack.Logger{
 		Filename:   "logs/log.log",
@@ -24,7 +30,7 @@ func NewLogger() *Logger {
 	}
 	consoleWriter := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: "2006-01-02 15:04:05"}
 	multi := zerolog.MultiLevelWriter(logger, consoleWriter)
-	zlog := zerolog.New(multi).With().Timestamp().Logger()
+	zlog := New(multi).Log
 
 	LOG_LEVEL := config.ConfigInstance.LogLevel
 	switch LOG_LEVEL {
@@ -54,4 +60,12 @@ func NewLogger() *Logger {
 	return &Logger{Log: zlog}
 }
 
-var ZLog *Logger = NewLogger()
+// ZLog writes the log of the service. It writes only to stdout until Configure creates it
+// from the configuration.
+var ZLog *Logger = New(os.Stdout)
+
+// Create RedactorInstance and ZLog once the command line flags are parsed.
+func Configure() {
+	RedactorInstance = NewConfiguredRedactor()
+	ZLog = NewLogger()
+}
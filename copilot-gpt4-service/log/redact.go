@@ -0,0 +1,172 @@
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"copilot-gpt4-service/config"
+)
+
+// Redacted replaces the secrets in the log output.
+const Redacted = "[REDACTED]"
+
+// A pattern of secrets and its replacement, which may keep a part of the match, e.g. ${1}.
+type redaction struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Secrets masked in every log line, whatever the configuration.
+var builtinRedactions = []redaction{
+	// Authorization headers
+	{regexp.MustCompile(`(?i)\b(bearer|basic)(\s+)[^\s"\\\],;]+`), "${1}${2}" + Redacted},
+	// GitHub tokens, e.g. the GitHub Copilot Plugin Tokens
+	{regexp.MustCompile(`\b(gh[pousr]_|github_pat_)[A-Za-z0-9_]+`), "${1}" + Redacted},
+	// Copilot tokens, tid=...;exp=...;...:signature
+	{regexp.MustCompile(`\btid=[^\s"\\]+`), "tid=" + Redacted},
+	// API keys, the prefixes of up to a few characters that identify a key are kept
+	{regexp.MustCompile(`\b(sk-)[A-Za-z0-9_\-]{20,}`), "${1}" + Redacted},
+}
+
+// Configured secrets shorter than this are not masked, they would mask common words, e.g. an
+// admin token "admin" would mask the path /admin/keys.
+const minSecretLength = 8
+
+// Headers whose values are never logged.
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "Api-Key"}
+
+// Redactor masks the secrets in the log output: the built-in token formats, the configured
+// secrets and the configured pattern, e.g. of personal data.
+type Redactor struct {
+	redactions []redaction
+	secrets    []string
+}
+
+// Create a new Redactor instance. The pattern is a regular expression, empty if none.
+func NewRedactor(pattern string, secrets ...string) (*Redactor, error) {
+	r := &Redactor{redactions: builtinRedactions}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.redactions = append(append([]redaction{}, builtinRedactions...), redaction{re, Redacted})
+	}
+	for _, secret := range secrets {
+		if secret = strings.TrimSpace(secret); len(secret) >= minSecretLength {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+	return r, nil
+}
+
+// Mask the secrets in the text.
+func (r *Redactor) Redact(text string) string {
+	for _, secret := range r.secrets {
+		text = replaceToken(text, secret)
+	}
+	for _, redaction := range r.redactions {
+		text = redaction.pattern.ReplaceAllString(text, redaction.replacement)
+	}
+	return text
+}
+
+// Whether the byte may be part of a token, the configured secrets are only masked as whole tokens.
+func isTokenByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_' || b == '-'
+}
+
+// Replace the occurrences of the secret in the text that are not part of a longer token.
+func replaceToken(text string, secret string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(text, secret)
+		if i < 0 {
+			break
+		}
+		end := i + len(secret)
+		if (i == 0 || !isTokenByte(text[i-1])) && (end == len(text) || !isTokenByte(text[end])) {
+			b.WriteString(text[:i])
+			b.WriteString(Redacted)
+		} else {
+			b.WriteString(text[:end])
+		}
+		text = text[end:]
+	}
+	b.WriteString(text)
+	return b.String()
+}
+
+// Return a writer that masks the secrets in what is written, before writing it to w.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &redactWriter{next: w, redactor: r}
+}
+
+type redactWriter struct {
+	next     io.Writer
+	redactor *Redactor
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	if _, err := w.next.Write([]byte(w.redactor.Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// The secrets of the configuration, which are masked wherever they appear as a whole token.
+func configuredSecrets() []string {
+	cfg := config.ConfigInstance
+	secrets := []string{cfg.CopilotToken, cfg.AdminToken}
+	for _, list := range []string{cfg.CopilotTokens, cfg.SuperToken, cfg.CacheKey} {
+		secrets = append(secrets, strings.Split(list, ",")...)
+	}
+	return secrets
+}
+
+// Create the Redactor of the configuration. An invalid pattern is reported and ignored,
+// the built-in token formats and the configured secrets are masked anyway.
+func NewConfiguredRedactor() *Redactor {
+	redactor, err := NewRedactor(config.ConfigInstance.LogRedactPattern, configuredSecrets()...)
+	if err != nil {
+		fmt.Println("Invalid log_redact_pattern, it is ignored:", err)
+		redactor, _ = NewRedactor("", configuredSecrets()...)
+	}
+	return redactor
+}
+
+// RedactorInstance masks the secrets in the output of ZLog. It masks only the built-in
+// token formats until Configure creates it from the configuration.
+var RedactorInstance *Redactor = &Redactor{redactions: builtinRedactions}
+
+// Mask the secrets in the text, as they are masked in the log output.
+func Redact(text string) string {
+	return RedactorInstance.Redact(text)
+}
+
+// Return a copy of the headers without the values of the headers carrying secrets.
+func RedactHeaders(headers http.Header) http.Header {
+	redacted := headers.Clone()
+	for _, name := range secretHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = []string{Redacted}
+		}
+	}
+	return redacted
+}
+
+// Return a short fingerprint of a secret to tell it apart in the logs: its first characters,
+// which tell its kind, and a hash.
+func Fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	prefix := ""
+	if len(secret) > 16 {
+		prefix = secret[:4]
+	}
+	return prefix + "…" + hex.EncodeToString(sum[:4])
+}
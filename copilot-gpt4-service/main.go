@@ -3,23 +3,48 @@ package main
 import (
 	"io"
 	"strings"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"golang.org/x/time/rate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"copilot-gpt4-service/cache"
 	"copilot-gpt4-service/config"
+	"copilot-gpt4-service/fakeupstream"
+	"copilot-gpt4-service/keys"
 	"copilot-gpt4-service/log"
+	"copilot-gpt4-service/metrics"
+	"copilot-gpt4-service/models"
+	"copilot-gpt4-service/openai"
+	"copilot-gpt4-service/pool"
+	"copilot-gpt4-service/ratelimit"
+	"copilot-gpt4-service/scheduler"
+	"copilot-gpt4-service/tokenizer"
 	"copilot-gpt4-service/tools"
+	"copilot-gpt4-service/tracing"
+	"copilot-gpt4-service/transport"
+	"copilot-gpt4-service/usage"
 	"copilot-gpt4-service/utils"
 )
 
@@ -40,67 +65,40 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
-// Represent the JSON data structure for the request body.
-type CompletionsJsonData struct {
-	Messages    interface{} `json:"messages"`
-	Model       string      `json:"model"`
-	Temperature float64     `json:"temperature"`
-	TopP        float64     `json:"top_p"`
-	N           int64       `json:"n"`
-	Stream      bool        `json:"stream"`
+// Default values of the chat completions request body, used for the fields the client leaves out.
+var completionsDefaults = map[string]interface{}{
+	"messages": []map[string]string{
+		{"role": "system",
+			"content": "\nYou are ChatGPT, a large language model trained by OpenAI.\nKnowledge cutoff: 2021-09\nCurrent model: gpt-4\n"},
+	},
+	"model":       "gpt-4",
+	"temperature": 0.5,
+	"top_p":       1,
+	"n":           1,
+	"stream":      false,
 }
 
-type EmbeddingsJsonData struct {
-	Input interface{} `json:"input"`
-	Model string      `json:"model"`
+// Default values of the embeddings request body.
+var embeddingsDefaults = map[string]interface{}{
+	"model": "text-embedding-ada-002",
 }
 
-type Message struct {
-	Role    *string `json:"role,omitempty"`
-	Content string  `json:"content"`
-}
-
-type Choice struct {
-	Delta         *Message `json:"delta,omitempty"`
-	Message       *Message `json:"message,omitempty"`
-	Index         int      `json:"index"`
-	Finish_reason *string  `json:"finish_reason"`
-}
-
-type Usage struct {
-	Prompt_tokens     int `json:"prompt_tokens"`
-	Completion_tokens int `json:"completion_tokens"`
-	Total_tokens      int `json:"total_tokens"`
-}
-
-type Data struct {
-	Choices []Choice `json:"choices,omitempty"`
-	Created int      `json:"created,omitempty"`
-	ID      string   `json:"id,omitempty"`
-	Object  string   `json:"object,omitempty"`
-	Model   string   `json:"model,omitempty"`
-	Usage   *Usage   `json:"usage,omitempty"`
-}
-
-type EmbeddingData struct {
-	Object    string        `json:"object"`
-	Index     int           `json:"index"`
-	Embedding []interface{} `json:"embedding"`
-}
-type EmbeddingUsage struct {
-	Prompt_tokens int `json:"prompt_tokens"`
-	Total_tokens  int `json:"total_tokens"`
-}
-type Embedding struct {
-	Object string          `json:"object"`
-	Data   []EmbeddingData `json:"data"`
-	Model  string          `json:"model"`
-	Usage  EmbeddingUsage  `json:"usage"`
+// Apply the defaults to the fields that are missing in the request body.
+func applyDefaults(body openai.Object, defaults map[string]interface{}) error {
+	for key, value := range defaults {
+		if err := body.SetDefault(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Create request headers to mock Github Copilot Chat requests.
-func createHeaders(apptoken string, stream bool) map[string]string {
+func createHeaders(ctx context.Context, apptoken string, stream bool) map[string]string {
+	_, span := tracing.Start(ctx, "cache.get")
 	item, ok := cache.CacheInstance.Get(apptoken)
+	span.SetAttributes(attribute.Bool(tracing.AttrCacheHit, ok))
+	span.End()
 	if !ok {
 		return nil
 	}
@@ -123,23 +121,61 @@ func createHeaders(apptoken string, stream bool) map[string]string {
 		"User-Agent":            "GitHubCopilotChat/0.8.0",
 		"Accept":                "*/*",
 		"Accept-Encoding":       "gzip,deflate,br",
-		"Connection":            "close",
 	}
 }
 
 func respondWithError(c *gin.Context, httpStatusCode int, errorMessage string) {
-	c.JSON(
-		httpStatusCode,
-		gin.H{
-			"error": errorMessage,
-			"code":  httpStatusCode,
-		},
-	)
-	c.Abort()
+	respondWithOpenAIError(c, openai.NewError(httpStatusCode, errorMessage))
+}
+
+// Respond with the error in the format of the OpenAI API and stop the handlers.
+func respondWithOpenAIError(c *gin.Context, e *openai.Error) {
+	c.AbortWithStatusJSON(e.Status, gin.H{"error": e})
+}
+
+// Respond with the error of an upstream response, the headers telling when to retry are passed on.
+func respondWithUpstreamError(c *gin.Context, resp *http.Response, body []byte) *openai.Error {
+	e := openai.UpstreamError(resp.StatusCode, body)
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		c.Header("Retry-After", retryAfter)
+	}
+	respondWithOpenAIError(c, e)
+	return e
+}
+
+// Respond with the error of a request to upstream that got no response.
+func respondWithRequestError(c *gin.Context, err error) *openai.Error {
+	status := http.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	e := openai.NewError(status, "Encountering an error when sending the request to github copilot: "+err.Error())
+	respondWithOpenAIError(c, e)
+	return e
+}
+
+// Status of the requests whose client went away before the response, as nginx reports them.
+const statusClientClosedRequest = 499
+
+// Whether the client of the request went away, which cancelled the upstream request. Nothing
+// can be sent to the client anymore, the request is recorded with the status 499.
+func abortIfClientGone(c *gin.Context) bool {
+	if c.Request.Context().Err() == nil {
+		return false
+	}
+	log.ZLog.Log.Info().Msg("The client disconnected before the response, the github copilot request was cancelled")
+	c.AbortWithStatus(statusClientClosedRequest)
+	return true
+}
+
+// Respond with the error of the token exchange, statusCode and errorInfo are those of the GitHub API.
+func respondWithAuthorizationError(c *gin.Context, statusCode int, errorInfo string) {
+	respondWithOpenAIError(c, openai.UpstreamError(statusCode, []byte(errorInfo)))
 }
 
 func chatCompletions(c *gin.Context) {
-	url := "https://api.githubcopilot.com/chat/completions"
+	url := config.ConfigInstance.CopilotAPIURL("/chat/completions")
+	start := time.Now()
 
 	// Get app token from request header
 	appToken, ok := utils.GetAuthorization(c)
@@ -147,121 +183,312 @@ func chatCompletions(c *gin.Context) {
 		respondWithError(c, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
+	upstreamStatus := 0
+	defer func() { utils.ReleaseAuthorization(c, upstreamStatus) }()
 
-	_, statusCode, errorInfo := utils.GetAuthorizationFromToken(appToken)
+	_, statusCode, errorInfo := utils.GetAuthorizationFromToken(c.Request.Context(), appToken)
 	if len(errorInfo) != 0 {
-		respondWithError(c, statusCode, errorInfo)
+		upstreamStatus = statusCode
+		respondWithAuthorizationError(c, statusCode, errorInfo)
 		return
 	}
 
-	jsonBody := &CompletionsJsonData{
-		Messages: []map[string]string{
-			{"role": "system",
-				"content": "\nYou are ChatGPT, a large language model trained by OpenAI.\nKnowledge cutoff: 2021-09\nCurrent model: gpt-4\n"},
-		},
-		Model:       "gpt-4",
-		Temperature: 0.5,
-		TopP:        1,
-		N:           1,
-		Stream:      false,
+	jsonBody, err := openai.ReadObject(c.Request.Body)
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return
 	}
-	_ = c.BindJSON(&jsonBody)
+	if err := applyDefaults(jsonBody, completionsDefaults); err != nil {
+		log.ZLog.Log.Error().Msgf("Error when applying the default values: %s", err.Error())
+		respondWithError(c, http.StatusInternalServerError, "Error when applying the default values.")
+		return
+	}
+	model := jsonBody.String("model")
+	stream := jsonBody.Bool("stream")
+	utils.SetRequestModel(c, model, stream)
+	if !utils.CheckKeyScope(c, model) {
+		respondWithError(c, http.StatusForbidden, fmt.Sprintf("The API key is not allowed to use the model %s on %s.", model, c.FullPath()))
+		return
+	}
+	// an alias is sent upstream as its model
+	if target := models.CatalogInstance.Resolve(model); target != model {
+		model = target
+		_ = jsonBody.Set("model", model)
+	}
+
+	// stream_options is answered by this service, since upstream does not report usage reliably
+	var streamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	}
+	_ = jsonBody.Get("stream_options", &streamOptions)
+	delete(jsonBody, "stream_options")
+	promptTokens := tokenizer.CountMessages(model, jsonBody["messages"]) +
+		tokenizer.CountTools(model, jsonBody["tools"]) + tokenizer.CountTools(model, jsonBody["functions"])
 
-	jsonData, err := json.Marshal(jsonBody)
+	jsonData, err := jsonBody.Marshal()
 	if err != nil {
 		log.ZLog.Log.Error().Msgf("Error when marshalling the JSON data: %s", err.Error())
 		respondWithError(c, http.StatusInternalServerError, "Error when marshalling the JSON data.")
 		return
 	}
 
-	headers := createHeaders(appToken, jsonBody.Stream)
-
-	req, _ := http.NewRequest("POST", url, bytes.NewReader(jsonData))
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	ctx, span := startUpstreamSpan(c.Request.Context(), "copilot.chat_completions", url, model)
+	defer span.End()
+	resp, err := sendUpstream(c, ctx, appToken, upstreamRequest{
+		endpoint: metrics.EndpointChatCompletions,
+		url:      url,
+		body:     jsonData,
+		stream:   stream,
+	})
 	if err != nil {
-		error_msg := fmt.Sprintf("Encountering an error when sending the request: %s", err.Error())
-		log.ZLog.Log.Err(err).Msg(error_msg)
-		respondWithError(c, http.StatusInternalServerError, error_msg)
+		if abortIfClientGone(c) {
+			return
+		}
+		e := respondWithRequestError(c, err)
+		log.ZLog.Log.Err(err).Msg(e.Message)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, e.Message)
 		return
 	}
 
 	defer resp.Body.Close()
+	upstreamStatus = resp.StatusCode
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
 	if resp.StatusCode != http.StatusOK {
-		error_msg := fmt.Sprintf("Encountering an error when receiving the github copilot response: %s", resp.Status)
-		log.ZLog.Log.Error().Msg(error_msg)
-		respondWithError(c, resp.StatusCode, error_msg)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBody))
+		e := respondWithUpstreamError(c, resp, body)
+		log.ZLog.Log.Error().Msgf("Encountering an error when receiving the github copilot response: %s, %s", resp.Status, e.Message)
+		span.SetStatus(codes.Error, resp.Status)
 		return
 	}
+
+	if stream {
+		streamStart := time.Now()
+		streamCompletions(c, resp, model, promptTokens, streamOptions.IncludeUsage, start)
+		span.SetAttributes(attribute.Int64(tracing.AttrStreamDuration, time.Since(streamStart).Milliseconds()))
+	} else {
+		collectCompletions(c, resp, model, promptTokens)
+	}
+}
+
+// Longest upstream error body read, the rest is dropped.
+const maxUpstreamErrorBody = 64 << 10
+
+// Start the client span of a request to the GitHub Copilot API. The trace
+// context is not sent upstream, the requests keep looking like the editor's.
+func startUpstreamSpan(ctx context.Context, name string, url string, model string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.HTTPRequestMethodPost,
+		semconv.URLFull(url),
+		attribute.String(tracing.AttrModel, model),
+	))
+}
+
+// Fill in the fields some upstream responses leave out.
+func completeResponseFields(data openai.Object, object string, model string) {
+	if data.String("object") == "" {
+		_ = data.Set("object", object)
+	}
+	if data.String("model") == "" {
+		_ = data.Set("model", model)
+	}
+	if data.Int("created") == 0 {
+		_ = data.Set("created", time.Now().Unix())
+	}
+}
+
+// Compute the usage from the collected response, unless upstream reported it.
+func completionUsage(collector *openai.Collector, model string, promptTokens int) openai.Usage {
+	if usage, ok := collector.Usage(); ok && usage.TotalTokens > 0 {
+		return usage
+	}
+	completionTokens := 0
+	for _, text := range collector.Texts() {
+		completionTokens += tokenizer.Count(model, text)
+	}
+	return openai.NewUsage(promptTokens, completionTokens)
+}
+
+// Forward the upstream event stream to the client chunk by chunk. start is the
+// time the request was received, to measure the time to the first token.
+func streamCompletions(c *gin.Context, resp *http.Response, model string, promptTokens int, includeUsage bool, start time.Time) {
+	defer metrics.StreamStarted()()
+	firstChunk := true
+
+	// on shutdown, or as soon as the client goes away, the upstream body is closed,
+	// which ends the scan below
+	cutoff, done := streams.Track()
+	defer done()
+	var cutOff, clientGone atomic.Bool
+	finished := make(chan struct{})
+	defer close(finished)
+	clientDone := c.Request.Context().Done()
+	go func() {
+		select {
+		case <-cutoff:
+			cutOff.Store(true)
+			resp.Body.Close()
+		case <-clientDone:
+			clientGone.Store(true)
+			resp.Body.Close()
+		case <-finished:
+		}
+	}()
+
 	// Set the headers for the response
 	c.Writer.Header().Set("Transfer-Encoding", "chunked")
 	c.Writer.Header().Set("X-Accel-Buffering", "no")
-	if jsonBody.Stream {
-		c.Header("Content-Type", "text/event-stream; charset=utf-8")
-	} else {
-		c.Header("Content-Type", "application/json; charset=utf-8")
-	}
+	c.Header("Content-Type", "text/event-stream; charset=utf-8")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
+
+	collector := openai.NewCollector()
+	usageSent := false
+	// The final chunk with empty choices that carries the usage of the whole stream.
+	writeUsage := func() {
+		if !includeUsage || usageSent {
+			return
+		}
+		usageSent = true
+		data := collector.Result()
+		_ = data.Set("choices", []interface{}{})
+		_ = data.Set("usage", completionUsage(collector, model, promptTokens))
+		completeResponseFields(data, "chat.completion.chunk", model)
+		_ = data.Set("object", "chat.completion.chunk")
+		newLine, err := data.Marshal()
+		if err != nil {
+			log.ZLog.Log.Error().Err(err).Msg("Error when marshalling the usage chunk")
+			return
+		}
+		c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\n", string(newLine))))
+		c.Writer.Flush()
+	}
+
 	// Scan the response body line by line
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		line := scanner.Bytes()
 
-		var object string
-		if jsonBody.Stream {
-			object = "chat.completion.chunk"
-		} else {
-			object = "chat.completion"
-		}
-
-		if len(line) > 0 && !bytes.Contains(line, []byte("data: [DONE]")) {
+		if bytes.Contains(line, []byte("data: [DONE]")) {
+			writeUsage()
+		} else if len(line) > 0 {
 			tmp := strings.TrimPrefix(string(line), "data: ")
-			data := &Data{}
-			if err := json.Unmarshal([]byte(tmp), &data); err != nil {
-				fmt.Println(err)
-			}
-			if len(data.Choices) == 0 {
+			data, err := openai.ParseObject([]byte(tmp))
+			if err != nil {
+				log.ZLog.Log.Error().Err(err).Msg("Error when parsing the github copilot response")
 				continue
 			}
-			if data.Object == "" {
-				data.Object = object
+			if _, ok := data["error"]; ok {
+				e := openai.UpstreamError(http.StatusBadGateway, []byte(tmp))
+				log.ZLog.Log.Error().Msgf("Error event in the github copilot response: %s", e.Message)
+				metrics.UpstreamError(metrics.EndpointChatCompletions, 0)
+				metrics.StreamAborted(metrics.AbortUpstream)
+				utils.SetUsage(c, completionUsage(collector, model, promptTokens))
+				writeStreamError(c, e)
+				return
 			}
-			if data.Model == "" {
-				data.Model = jsonBody.Model
-			}
-			if data.Created == 0 {
-				data.Created = int(time.Now().Unix())
+			collector.Add(data)
+			if len(data.Objects("choices")) == 0 {
+				continue
 			}
+			completeResponseFields(data, "chat.completion.chunk", model)
 
-			newLine, err := json.Marshal(data)
+			newLine, err := data.Marshal()
 			if err != nil {
-				fmt.Println(err)
+				log.ZLog.Log.Error().Err(err).Msg("Error when marshalling the response chunk")
+				continue
 			}
-			if jsonBody.Stream {
-				line = []byte(fmt.Sprintf("data: %s", string(newLine)))
-			} else {
-				line = newLine
+			line = []byte(fmt.Sprintf("data: %s", string(newLine)))
+			if firstChunk {
+				firstChunk = false
+				metrics.ObserveTimeToFirstToken(model, time.Since(start))
 			}
 		}
 
-		c.Writer.Write(line)
-		c.Writer.Write([]byte("\n")) // Add newline to the end of each line
+		_, err := c.Writer.Write(line)
+		if err == nil {
+			_, err = c.Writer.Write([]byte("\n")) // Add newline to the end of each line
+		}
+		if err != nil {
+			clientGone.Store(true)
+			resp.Body.Close()
+			break
+		}
 		c.Writer.Flush()
 	}
+	// the upstream request is cancelled along with the client's, which may end the scan first
+	if clientGone.Load() || c.Request.Context().Err() != nil {
+		usage := completionUsage(collector, model, promptTokens)
+		utils.SetUsage(c, usage)
+		log.ZLog.Log.Info().Msgf("The client disconnected, the github copilot stream was aborted after %d completion tokens", usage.CompletionTokens)
+		metrics.StreamAborted(metrics.AbortClient)
+		return
+	}
+	if cutOff.Load() {
+		utils.SetUsage(c, completionUsage(collector, model, promptTokens))
+		metrics.StreamAborted(metrics.AbortShutdown)
+		writeStreamError(c, openai.NewError(http.StatusServiceUnavailable, "The service is shutting down, the response was cut off."))
+		return
+	}
 	if err := scanner.Err(); err != nil {
-		c.AbortWithError(http.StatusBadGateway, err)
+		log.ZLog.Log.Err(err).Msg("Error when reading the github copilot response stream")
+		metrics.UpstreamError(metrics.EndpointChatCompletions, 0)
+		metrics.StreamAborted(metrics.AbortUpstream)
+		utils.SetUsage(c, completionUsage(collector, model, promptTokens))
+		writeStreamError(c, openai.NewError(http.StatusBadGateway, "The github copilot response was interrupted: "+err.Error()))
+		return
+	}
+	writeUsage()
+	utils.SetUsage(c, completionUsage(collector, model, promptTokens))
+}
+
+// End an event stream with an error event, for errors after the response started.
+func writeStreamError(c *gin.Context, e *openai.Error) {
+	data, _ := e.Marshal()
+	c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\ndata: [DONE]\n\n", data)))
+	c.Writer.Flush()
+}
+
+// Merge the upstream response, streamed or not, into a single chat.completion object.
+func collectCompletions(c *gin.Context, resp *http.Response, model string, promptTokens int) {
+	collector := openai.NewCollector()
+	if err := collector.Collect(resp.Body); err != nil {
+		if abortIfClientGone(c) {
+			return
+		}
+		error_msg := fmt.Sprintf("Encountering an error when reading the github copilot response: %s", err.Error())
+		log.ZLog.Log.Err(err).Msg(error_msg)
+		respondWithError(c, http.StatusBadGateway, error_msg)
 		return
 	}
+	if event, ok := collector.ErrorEvent(); ok {
+		e := openai.UpstreamError(http.StatusBadGateway, event)
+		log.ZLog.Log.Error().Msgf("Error event in the github copilot response: %s", e.Message)
+		metrics.UpstreamError(metrics.EndpointChatCompletions, 0)
+		respondWithOpenAIError(c, e)
+		return
+	}
+
+	data := collector.Result()
+	completeResponseFields(data, "chat.completion", model)
+	if data.String("id") == "" {
+		_ = data.Set("id", "chatcmpl-"+tools.GenHexStr(24))
+	}
+	usage := completionUsage(collector, model, promptTokens)
+	_ = data.Set("usage", usage)
+	utils.SetUsage(c, usage)
 
+	body, err := data.Marshal()
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Error when marshalling the response")
+		respondWithError(c, http.StatusInternalServerError, "Error when marshalling the response.")
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
 }
 
 func embeddings(c *gin.Context) {
-	url := "https://api.githubcopilot.com/embeddings"
+	url := config.ConfigInstance.CopilotAPIURL("/embeddings")
 
 	// Get app token from request header
 	appToken, ok := utils.GetAuthorization(c)
@@ -269,49 +496,86 @@ func embeddings(c *gin.Context) {
 		respondWithError(c, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
+	upstreamStatus := 0
+	defer func() { utils.ReleaseAuthorization(c, upstreamStatus) }()
 
-	_, statusCode, errorInfo := utils.GetAuthorizationFromToken(appToken)
+	_, statusCode, errorInfo := utils.GetAuthorizationFromToken(c.Request.Context(), appToken)
 	if len(errorInfo) != 0 {
-		respondWithError(c, statusCode, errorInfo)
+		upstreamStatus = statusCode
+		respondWithAuthorizationError(c, statusCode, errorInfo)
 		return
 	}
 
-	jsonBody := &EmbeddingsJsonData{
-		Input: "",
-		Model: "text-embedding-ada-002",
+	jsonBody, err := openai.ReadObject(c.Request.Body)
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+	if err := applyDefaults(jsonBody, embeddingsDefaults); err != nil {
+		log.ZLog.Log.Error().Msgf("Error when applying the default values: %s", err.Error())
+		respondWithError(c, http.StatusInternalServerError, "Error when applying the default values.")
+		return
+	}
+	model := jsonBody.String("model")
+	utils.SetRequestModel(c, model, false)
+	if !utils.CheckKeyScope(c, model) {
+		respondWithError(c, http.StatusForbidden, fmt.Sprintf("The API key is not allowed to use the model %s on %s.", model, c.FullPath()))
+		return
 	}
-	_ = c.BindJSON(&jsonBody)
+	// an alias is sent upstream as its model
+	if target := models.CatalogInstance.Resolve(model); target != model {
+		model = target
+		_ = jsonBody.Set("model", model)
+	}
+
 	// check if the input is empty, if so, return an error
-	if jsonBody.Input == "" {
+	var input interface{}
+	_ = jsonBody.Get("input", &input)
+	if input == nil || input == "" {
 		respondWithError(c, http.StatusBadRequest, "Input cannot be empty.")
 		return
 	}
 	// check if the input is a list, if not, wrap it in a list
-	if _, ok := jsonBody.Input.([]interface{}); !ok {
-		jsonBody.Input = []interface{}{jsonBody.Input}
+	if _, ok := input.([]interface{}); !ok {
+		_ = jsonBody.Set("input", []interface{}{input})
 	}
 
-	jsonData, err := json.Marshal(jsonBody)
+	jsonData, err := jsonBody.Marshal()
 	if err != nil {
 		log.ZLog.Log.Error().Msgf("Error when marshalling the JSON data: %s", err.Error())
 		respondWithError(c, http.StatusInternalServerError, "Error when marshalling the JSON data.")
 		return
 	}
 
-	headers := createHeaders(appToken, false)
+	headers := createHeaders(c.Request.Context(), appToken, false)
 
-	req, _ := http.NewRequest("POST", url, bytes.NewReader(jsonData))
+	ctx, span := startUpstreamSpan(c.Request.Context(), "copilot.embeddings", url, model)
+	defer span.End()
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonData))
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := transport.ClientInstance.Do(req)
 	if err != nil {
-		fmt.Println("Encountering an error when sending the request.")
+		if abortIfClientGone(c) {
+			return
+		}
+		e := respondWithRequestError(c, err)
+		log.ZLog.Log.Err(err).Msg(e.Message)
+		metrics.UpstreamError(metrics.EndpointEmbeddings, 0)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, e.Message)
 	} else {
 		defer resp.Body.Close()
+		upstreamStatus = resp.StatusCode
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
 		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBody))
+			e := respondWithUpstreamError(c, resp, body)
+			log.ZLog.Log.Error().Msgf("Encountering an error when receiving the github copilot response: %s, %s", resp.Status, e.Message)
+			metrics.UpstreamError(metrics.EndpointEmbeddings, resp.StatusCode)
+			span.SetStatus(codes.Error, resp.Status)
 			return
 		} else {
 			// Set the headers for the response
@@ -327,28 +591,42 @@ func embeddings(c *gin.Context) {
 				line := scanner.Bytes()
 
 				if len(line) > 0 {
-					data := &Embedding{}
-					if err := json.Unmarshal([]byte(line), &data); err != nil {
-						fmt.Println(err)
+					data, err := openai.ParseObject(line)
+					if err != nil {
+						log.ZLog.Log.Error().Err(err).Msg("Error when parsing the github copilot response")
+						continue
 					}
-					if len(data.Data) == 0 {
+					items := data.Objects("data")
+					if len(items) == 0 {
 						continue
 					}
-					if data.Object == "" {
-						data.Object = "list"
+					if data.String("object") == "" {
+						_ = data.Set("object", "list")
 					}
-					for i := 0; i < len(data.Data); i++ {
-						if data.Data[i].Object == "" {
-							data.Data[i].Object = "embedding"
+					for _, item := range items {
+						if item.String("object") == "" {
+							_ = item.Set("object", "embedding")
 						}
 					}
-					if data.Model == "" {
-						data.Model = jsonBody.Model
+					_ = data.Set("data", items)
+					if data.String("model") == "" {
+						_ = data.Set("model", model)
+					}
+					var usage openai.Usage
+					_ = data.Get("usage", &usage)
+					if usage.PromptTokens == 0 {
+						usage = openai.NewUsage(tokenizer.CountInput(model, input), 0)
+						_ = data.Set("usage", map[string]int{
+							"prompt_tokens": usage.PromptTokens,
+							"total_tokens":  usage.TotalTokens,
+						})
 					}
+					utils.SetUsage(c, usage)
 
-					newLine, err := json.Marshal(data)
+					newLine, err := data.Marshal()
 					if err != nil {
-						fmt.Println(err)
+						log.ZLog.Log.Error().Err(err).Msg("Error when marshalling the embeddings response")
+						continue
 					}
 					line = newLine
 				}
@@ -361,48 +639,11 @@ func embeddings(c *gin.Context) {
 	}
 }
 
-func createMockModel(modelId string) gin.H {
-	return gin.H{
-		"id":       modelId,
-		"object":   "model",
-		"created":  1677610602,
-		"owned_by": "openai",
-		"permission": []gin.H{
-			{
-				"id":                   "modelperm-" + tools.GenHexStr(12),
-				"object":               "model_permission",
-				"created":              1677610602,
-				"allow_create_engine":  false,
-				"allow_sampling":       true,
-				"allow_logprobs":       true,
-				"allow_search_indices": false,
-				"allow_view":           true,
-				"allow_fine_tuning":    false,
-				"organization":         "*",
-				"group":                nil,
-				"is_blocking":          false,
-			},
-		},
-		"root":   modelId,
-		"parent": nil,
-	}
-}
-
-func createMockModelsResponse(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"object": "list",
-		"data": []gin.H{
-			createMockModel("gpt-3.5-turbo"),
-			createMockModel("gpt-4"),
-		},
-	})
-}
-
 // corsProxyNextChat endpoint handler for proxying requests from nextChat desktop app
 func corsProxyNextChat(c *gin.Context) {
 	sp := strings.Split(c.Param("path"), "/")
 	if len(sp) < 3 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid proxy path"})
+		respondWithError(c, http.StatusBadRequest, "Invalid proxy path")
 		return
 	}
 
@@ -414,26 +655,26 @@ func corsProxyNextChat(c *gin.Context) {
 	}
 	url, err := url.Parse(fmt.Sprintf("%s://%s%s", proto, host, path))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondWithError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	method := c.Request.Header.Get("Method")
 	c.Request.Header.Del("Method")
 	if method == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Method header is not set"})
+		respondWithError(c, http.StatusBadRequest, "Method header is not set")
 		return
 	}
 	proxyReq, err := http.NewRequest(method, url.String(), c.Request.Body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 	proxyReq.Header = c.Request.Header
 
-	resp, err := http.DefaultClient.Do(proxyReq)
+	resp, err := transport.ClientInstance.Do(proxyReq)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondWithError(c, http.StatusBadGateway, err.Error())
 		return
 	}
 	defer resp.Body.Close()
@@ -448,7 +689,7 @@ func corsProxyNextChat(c *gin.Context) {
 
 	_, err = io.Copy(c.Writer, resp.Body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 }
@@ -459,38 +700,162 @@ func LoggerHandler() gin.HandlerFunc {
 
 		log.ZLog.Log.Info().Msgf("Request Info:\nMethod: %s\nHost: %s\nURL: %s",
 			c.Request.Method, c.Request.Host, c.Request.URL)
-		log.ZLog.Log.Debug().Msgf("Request Header:\n%v", c.Request.Header)
+		log.ZLog.Log.Debug().Msgf("Request Header:\n%v", log.RedactHeaders(c.Request.Header))
 
 		c.Next()
 
 		latency := time.Since(t)
 		log.ZLog.Log.Info().Msgf("Response Time: %s\nStatus: %d",
 			latency.String(), c.Writer.Status())
-		log.ZLog.Log.Debug().Msgf("Response Header:\n%v", c.Writer.Header())
+		log.ZLog.Log.Debug().Msgf("Response Header:\n%v", log.RedactHeaders(c.Writer.Header()))
 	}
 }
 
-func RateLimiterHandler(reqsPerMin int) gin.HandlerFunc {
-	var limiter *rate.Limiter
-	if reqsPerMin > 0 {
-		limiter = rate.NewLimiter(rate.Every(time.Minute), reqsPerMin)
-	} else {
-		limiter = rate.NewLimiter(rate.Inf, 0)
+// Start a server span for every request, continuing the trace of the incoming traceparent header.
+func TracingHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := tracing.Propagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		name := c.Request.Method
+		attributes := []attribute.KeyValue{
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.URLPath(c.Request.URL.Path),
+			semconv.UserAgentOriginal(c.Request.UserAgent()),
+		}
+		if route := c.FullPath(); route != "" {
+			name += " " + route
+			attributes = append(attributes, semconv.HTTPRoute(route))
+		}
+		ctx, span := tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attributes...))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		if model, stream := utils.GetRequestModel(c); model != "" {
+			span.SetAttributes(attribute.String(tracing.AttrModel, model), attribute.Bool(tracing.AttrStream, stream))
+		}
+		if u, ok := utils.GetUsage(c); ok {
+			span.SetAttributes(attribute.Int(tracing.AttrPromptTokens, u.PromptTokens), attribute.Int(tracing.AttrCompletionTokens, u.CompletionTokens))
+		}
+	}
+}
+
+// Record the request count, latency and tokens of every request in the Prometheus metrics.
+func MetricsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := time.Now()
+
+		c.Next()
+
+		model, _ := utils.GetRequestModel(c)
+		metrics.ObserveRequest(c.FullPath(), c.Writer.Status(), model, time.Since(t))
+		if u, ok := utils.GetUsage(c); ok {
+			metrics.AddTokens(model, u)
+		}
 	}
+}
 
+// Record the usage of every call in the usage ledger, which lives in the cache database.
+func UsageRecorderHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !limiter.Allow() {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
-				"message": "too many requests",
-			})
+		if !cache.CacheInstance.HasDB() {
+			c.Next()
 			return
 		}
+		t := time.Now()
+
 		c.Next()
+
+		record := usage.Record{
+			CreatedAt: t.Unix(),
+			Identity:  utils.CallerIdentity(c),
+			Endpoint:  c.FullPath(),
+			LatencyMs: time.Since(t).Milliseconds(),
+			Status:    c.Writer.Status(),
+		}
+		if key := utils.GetAPIKey(c); key != nil {
+			record.KeyID = key.ID
+		}
+		record.Model, record.Stream = utils.GetRequestModel(c)
+		if u, ok := utils.GetUsage(c); ok {
+			record.PromptTokens = u.PromptTokens
+			record.CompletionTokens = u.CompletionTokens
+		}
+		_ = usage.LedgerInstance.Record(record)
 	}
 }
 
+// Set the OpenAI style x-ratelimit-* headers of the limits that are enabled.
+func setRateLimitHeaders(c *gin.Context, status ratelimit.Status) {
+	if status.Limits.RequestsPerMinute > 0 {
+		c.Header("x-ratelimit-limit-requests", strconv.Itoa(status.Limits.RequestsPerMinute))
+		c.Header("x-ratelimit-remaining-requests", strconv.Itoa(status.RemainingRequests))
+		c.Header("x-ratelimit-reset-requests", status.ResetRequests.Round(time.Millisecond).String())
+	}
+	if status.Limits.TokensPerMinute > 0 {
+		c.Header("x-ratelimit-limit-tokens", strconv.Itoa(status.Limits.TokensPerMinute))
+		c.Header("x-ratelimit-remaining-tokens", strconv.Itoa(status.RemainingTokens))
+		c.Header("x-ratelimit-reset-tokens", status.ResetTokens.Round(time.Millisecond).String())
+	}
+}
+
+// Limit the requests per minute, tokens per minute and concurrent requests of every caller.
+func RateLimiterHandler(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !limiter.Enabled() {
+			c.Next()
+			return
+		}
+
+		identity := utils.CallerIdentity(c)
+		status, release := limiter.Acquire(identity)
+		setRateLimitHeaders(c, status)
+		if release == nil {
+			retryAfter := int(math.Ceil(status.RetryAfter.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			log.ZLog.Log.Warn().Msgf("Rate limit of %s exceeded, caller: %s", status.Rejected, identity)
+			respondWithError(c, http.StatusTooManyRequests, fmt.Sprintf("Too many requests: rate limit of %s exceeded, please retry after %d seconds.", status.Rejected, retryAfter))
+			return
+		}
+
+		// released even if a handler panics, the recovery of gin would skip it otherwise
+		defer func() {
+			usage, _ := utils.GetUsage(c)
+			release(usage.TotalTokens)
+		}()
+		c.Next()
+	}
+}
+
+// Return a copy of the configuration to print, with the secrets masked and the passwords
+// removed from the URLs.
+func maskedConfig() config.Config {
+	cfg := *config.ConfigInstance
+	for _, secret := range []*string{&cfg.CopilotToken, &cfg.CopilotTokens, &cfg.SuperToken, &cfg.AdminToken, &cfg.CacheKey} {
+		if *secret != "" {
+			*secret = log.Redacted
+		}
+	}
+	for _, rawURL := range []*string{&cfg.CacheURL, &cfg.OutboundProxy} {
+		if u, err := url.Parse(*rawURL); err == nil {
+			*rawURL = u.Redacted()
+		} else if *rawURL != "" {
+			*rawURL = log.Redacted
+		}
+	}
+	return cfg
+}
+
 func startupOutput() {
-	tools.PrintStructFieldsAndValues(config.ConfigInstance, "Copilot-GPT4-Service startup configuration:")
+	tools.PrintStructFieldsAndValues(maskedConfig(), "Copilot-GPT4-Service startup configuration:")
 	fmt.Println("Service is running at:")
 	fmt.Printf(" - %-20s: %s\n", "Local", tools.Colorize(tools.ColorGreen, fmt.Sprintf("http://%s:%d", config.ConfigInstance.Host, config.ConfigInstance.Port)))
 
@@ -505,14 +870,19 @@ func startupOutput() {
 
 	fmt.Println("(Press CTRL+C to quit)")
 
+	if config.ConfigInstance.FakeUpstream {
+		fmt.Println()
+		fmt.Println(tools.Colorize(tools.ColorYellow, fmt.Sprintf("WARNING: FAKE_UPSTREAM is enabled, every request is answered by the fake upstream at %s instead of GitHub Copilot.", config.ConfigInstance.CopilotAPIBase)))
+	}
+
 	if config.ConfigInstance.CORSProxyNextChat {
 		fmt.Println()
 		fmt.Println(tools.Colorize(tools.ColorYellow, "WARNING: CORS_PROXY_NEXTCHAT is enabled. This is a potential security risk if your service is not private."))
 	}
 
-	if config.ConfigInstance.CopilotToken != "" && !config.ConfigInstance.EnableSuperToken {
+	if pool.PoolInstance.Len() > 0 && !config.ConfigInstance.EnableSuperToken {
 		fmt.Println()
-		fmt.Println(tools.Colorize(tools.ColorYellow, "WARNING: COPILOT_TOKEN is set, but ENABLE_SUPER_TOKEN is not enabled. This is a potential security risk if your service is not private."))
+		fmt.Println(tools.Colorize(tools.ColorYellow, "WARNING: COPILOT_TOKEN or COPILOT_TOKENS is set, but ENABLE_SUPER_TOKEN is not enabled. This is a potential security risk if your service is not private."))
 	}
 
 	fmt.Println()
@@ -530,49 +900,108 @@ func startupCheck() {
 		fmt.Println(tools.Colorize(tools.ColorRed, "You enabled super token but didn't set the super token, please set the super token in the configuration file."))
 	}
 
+	if err := cache.CacheInstance.LoadKeys(); err != nil {
+		fmt.Println(tools.Colorize(tools.ColorRed, "Load the cache key failed: "+err.Error()+". Please check the configuration of CACHE_KEY or CACHE_KEY_FILE, one of them is required for a Redis cache."))
+		os.Exit(1)
+	}
+
+	if config.ConfigInstance.AdminToken != "" && !cache.CacheInstance.HasDB() {
+		fmt.Println(tools.Colorize(tools.ColorRed, "API keys are stored in the sqlite cache database, please enable CACHE (without a CACHE_URL of another store) to manage API keys with the admin API."))
+	}
+
 	if !tools.FilExists("./robots.txt") {
 		fmt.Println(tools.Colorize(tools.ColorYellow, "robots.txt not found, creating it..."))
 		tools.WriteToFile("./robots.txt", "User-agent: *\nDisallow: /\n", 0644)
 	}
 }
 
+// Create the instances of the packages once the command line flags are parsed, from the
+// command line, the environment and config.env.
+func initInstances() {
+	cfg := config.ConfigInstance
+	client, err := transport.NewConfiguredClient()
+	if err != nil {
+		log.ZLog.Log.Fatal().Err(err).Msg("Invalid OUTBOUND_PROXY, please check the configuration.")
+	}
+	transport.ClientInstance = client
+	cache.CacheInstance = cache.NewCache(cfg.CacheStoreURL(), cfg.CacheKey, cfg.CacheKeyFile)
+	keys.StoreInstance = keys.NewStore(cache.CacheInstance)
+	usage.LedgerInstance = usage.NewLedger(cache.CacheInstance)
+	pool.PoolInstance = pool.New(pool.Tokens(cfg.CopilotToken, cfg.CopilotTokens), pool.Strategy(cfg.PoolStrategy), time.Duration(cfg.PoolCooldown)*time.Second)
+	models.CatalogInstance = models.NewCatalog(time.Duration(cfg.ModelsTTL)*time.Second, cfg.ModelsOffline, models.Names(cfg.ModelsStatic), models.ParseAliases(cfg.ModelAliases))
+}
+
 func main() {
+	config.Load()
+	log.Configure()
+	initInstances()
+
+	if flag.Arg(0) == "migrate" {
+		os.Exit(runMigrate(flag.Args()[1:]))
+	}
+
 	if config.ConfigInstance.Debug {
 		gin.SetMode(gin.DebugMode)
 	} else {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	router := gin.Default()
-	router.Use(CORSMiddleware())
-	router.Use(LoggerHandler())
-
-	router.StaticFile("/robots.txt", "./robots.txt")
-
-	router.POST("/v1/chat/completions", RateLimiterHandler(config.ConfigInstance.RateLimit), chatCompletions)
-	router.POST("/v1/embeddings", RateLimiterHandler(config.ConfigInstance.RateLimit), embeddings)
-	router.GET("/v1/models", createMockModelsResponse)
-	router.GET("/healthz", func(context *gin.Context) {
-		context.JSON(200, gin.H{
-			"message": "ok",
-		})
-	})
-	router.GET("/", func(c *gin.Context) {
-		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(`
-		<div style="color:red;padding:0 20px;display:grid;align-items:center;justify-content:center;height:98vh;overflow:hidden;font-size:20px;line-height:30px;text-align:center;"><b>Very important: please do not make this service public, for personal use only, otherwise the account or Copilot will be banned.<br>非常重要：请不要将此服务公开，仅供个人使用，否则账户或 Copilot 将被封禁。</b></div>`))
-	})
-	router.NoRoute(func(c *gin.Context) {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-			"message": fmt.Sprintf("Invalid URL (%s %s)", c.Request.Method, c.Request.URL.Path),
-		})
-	})
+	if config.ConfigInstance.FakeUpstream {
+		baseURL, err := fakeupstream.New().Listen("127.0.0.1:0")
+		if err != nil {
+			log.ZLog.Log.Fatal().Err(err).Msg("Start fake upstream failed")
+		}
+		config.ConfigInstance.CopilotAPIBase = baseURL
+		config.ConfigInstance.GitHubAPIBase = baseURL
+	}
 
-	if config.ConfigInstance.CORSProxyNextChat {
-		router.Any("/cors-proxy-nextchat/*path", corsProxyNextChat)
+	shutdownTracing, err := tracing.Init(config.ConfigInstance.Tracing, config.ConfigInstance.TracingFile)
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Set up tracing failed, tracing is disabled")
+		shutdownTracing = func(context.Context) error { return nil }
 	}
 
+	router := NewRouter()
+
 	startupCheck()
 	startupOutput()
 
-	router.Run(fmt.Sprintf("%s:%d", config.ConfigInstance.Host, config.ConfigInstance.Port))
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.ConfigInstance.Host, config.ConfigInstance.Port))
+	if err != nil {
+		log.ZLog.Log.Fatal().Err(err).Msg("Listen failed")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	refreshInterval := time.Duration(config.ConfigInstance.TokenRefreshInterval) * time.Second
+	waitJobs := scheduler.Start(ctx,
+		scheduler.Job{
+			Name:     "cache janitor",
+			Interval: time.Duration(config.ConfigInstance.CacheCleanInterval) * time.Second,
+			Run: func(context.Context) {
+				if removed := cache.CacheInstance.Clean(); removed > 0 {
+					log.ZLog.Log.Info().Msgf("Removed %d cache items that have not been touched for a long time", removed)
+				}
+			},
+		},
+		scheduler.Job{
+			Name:     "token refresher",
+			Interval: refreshInterval,
+			Run: func(ctx context.Context) {
+				utils.RefreshAuthorizations(ctx, refreshInterval)
+			},
+		},
+	)
+
+	server := &http.Server{Handler: router}
+	err = serve(ctx, server, listener, time.Duration(config.ConfigInstance.ShutdownTimeout)*time.Second)
+	// the jobs stop when the context is done, which is not the case yet if the server failed
+	stop()
+	waitJobs()
+	cache.CacheInstance.Close()
+	shutdownTracing(context.Background())
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Server failed")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"copilot-gpt4-service/models"
+	"copilot-gpt4-service/openai"
+)
+
+const namespace = "copilot"
+
+// Upstream endpoints, used as the endpoint label of the upstream errors.
+const (
+	EndpointToken           = "token"
+	EndpointChatCompletions = "chat_completions"
+	EndpointEmbeddings      = "embeddings"
+	EndpointModels          = "models"
+)
+
+// OtherModel is the model label of the models that are not in the models catalog, the model
+// comes from the request body and would otherwise allow any client to add label values.
+const OtherModel = "other"
+
+// Return the model label of the model requested by the client.
+func modelLabel(model string) string {
+	if model == "" || models.CatalogInstance.Known(model) {
+		return model
+	}
+	return OtherModel
+}
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests served, by route, status and model.",
+	}, []string{"route", "status", "model"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests, by route, status and model.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"route", "status", "model"})
+
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_time_to_first_token_seconds",
+		Help:      "Time from the request until the first chunk of a streamed completion is sent, by model.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 8, 13, 20, 30},
+	}, []string{"model"})
+
+	streamsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "streams_in_flight",
+		Help:      "Number of completions currently being streamed to clients.",
+	})
+
+	streamsAborted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "streams_aborted_total",
+		Help:      "Number of completion streams that ended before upstream finished them, by reason (client, shutdown or upstream).",
+	}, []string{"reason"})
+
+	tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Number of tokens, by model and direction (in for prompt, out for completion).",
+	}, []string{"model", "direction"})
+
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Number of failed upstream requests, by upstream endpoint and status (0 if upstream was not reached).",
+	}, []string{"endpoint", "status"})
+
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Number of upstream requests retried after a failed attempt, by upstream endpoint and reason.",
+	}, []string{"endpoint", "reason"})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Number of GitHub Copilot tokens obtained from GitHub, by result.",
+	}, []string{"result"})
+
+	tokenCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_cache_lookups_total",
+		Help:      "Number of GitHub Copilot token lookups in the cache, by result (hit or miss).",
+	}, []string{"result"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Record a served HTTP request. Requests that did not match a route are recorded with the route "unmatched".
+func ObserveRequest(route string, status int, model string, duration time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	statusLabel := strconv.Itoa(status)
+	model = modelLabel(model)
+	requests.WithLabelValues(route, statusLabel, model).Inc()
+	requestDuration.WithLabelValues(route, statusLabel, model).Observe(duration.Seconds())
+}
+
+// Record the time to the first chunk of a streamed completion.
+func ObserveTimeToFirstToken(model string, duration time.Duration) {
+	timeToFirstToken.WithLabelValues(modelLabel(model)).Observe(duration.Seconds())
+}
+
+// Count a stream as started, the returned function counts it as done.
+func StreamStarted() func() {
+	streamsInFlight.Inc()
+	return streamsInFlight.Dec
+}
+
+// Reasons of the aborted streams: the client went away, the service shut down or upstream failed.
+const (
+	AbortClient   = "client"
+	AbortShutdown = "shutdown"
+	AbortUpstream = "upstream"
+)
+
+// Count a stream that ended before upstream finished it.
+func StreamAborted(reason string) {
+	streamsAborted.WithLabelValues(reason).Inc()
+}
+
+// Record the tokens of a call.
+func AddTokens(model string, usage openai.Usage) {
+	model = modelLabel(model)
+	if usage.PromptTokens > 0 {
+		tokens.WithLabelValues(model, "in").Add(float64(usage.PromptTokens))
+	}
+	if usage.CompletionTokens > 0 {
+		tokens.WithLabelValues(model, "out").Add(float64(usage.CompletionTokens))
+	}
+}
+
+// Record a failed upstream request. status is 0 if upstream was not reached.
+func UpstreamError(endpoint string, status int) {
+	upstreamErrors.WithLabelValues(endpoint, strconv.Itoa(status)).Inc()
+}
+
+// Reasons of the upstream retries.
+const (
+	RetryNetwork  = "network"
+	RetryStatus   = "status"
+	RetryRenew    = "renew"
+	RetryFailover = "failover"
+)
+
+// Record a retry of an upstream request after a failed attempt.
+func UpstreamRetry(endpoint string, reason string) {
+	upstreamRetries.WithLabelValues(endpoint, reason).Inc()
+}
+
+// Record a GitHub Copilot token obtained from GitHub, or the failure to obtain it.
+func TokenRefresh(ok bool) {
+	if ok {
+		tokenRefreshes.WithLabelValues("success").Inc()
+	} else {
+		tokenRefreshes.WithLabelValues("failure").Inc()
+	}
+}
+
+// Record a lookup of a GitHub Copilot token in the cache.
+func TokenCacheLookup(hit bool) {
+	if hit {
+		tokenCacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		tokenCacheLookups.WithLabelValues("miss").Inc()
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"copilot-gpt4-service/log"
+	"copilot-gpt4-service/models"
+)
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Return the model label values of the metric family.
+func modelLabels(t *testing.T, family string) map[string]bool {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]bool)
+	for _, f := range families {
+		if f.GetName() != family {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "model" {
+					labels[label.GetValue()] = true
+				}
+			}
+		}
+	}
+	return labels
+}
+
+func TestModelLabelBounded(t *testing.T) {
+	saved := models.CatalogInstance
+	t.Cleanup(func() { models.CatalogInstance = saved })
+	models.CatalogInstance = models.NewCatalog(time.Hour, true, []string{"static-model"}, map[string]string{"my-alias": "static-model"})
+
+	for _, model := range []string{"static-model", "my-alias", "made-up-1", "made-up-2", ""} {
+		ObserveRequest("/v1/chat/completions", 200, model, time.Millisecond)
+		ObserveTimeToFirstToken(model, time.Millisecond)
+	}
+	for _, family := range []string{"copilot_http_requests_total", "copilot_stream_time_to_first_token_seconds"} {
+		labels := modelLabels(t, family)
+		for _, want := range []string{"static-model", "my-alias", OtherModel} {
+			if !labels[want] {
+				t.Errorf("%s: missing model label %q in %v", family, want, labels)
+			}
+		}
+		for label := range labels {
+			if strings.HasPrefix(label, "made-up") {
+				t.Errorf("%s: a model that is not in the catalog is used as label %q", family, label)
+			}
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	UpstreamError(EndpointToken, 401)
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `copilot_upstream_errors_total{endpoint="token",status="401"}`) {
+		t.Fatalf("upstream error not exposed:\n%s", recorder.Body.String())
+	}
+}
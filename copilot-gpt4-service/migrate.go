@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"copilot-gpt4-service/cache"
+	"copilot-gpt4-service/config"
+	"copilot-gpt4-service/migrate"
+)
+
+const migrateUsage = `Usage: copilot-gpt4-service [flags] migrate <command>
+
+Migrate the schema of the sqlite cache database. The service applies the pending
+migrations itself when it starts, this allows to check and apply them beforehand.
+
+Commands:
+  status           list the migrations and whether they are applied
+  up [-dry_run]    apply the pending migrations, with -dry_run they are rolled back
+`
+
+// Run the migrate subcommand with its arguments and return the exit code.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return 2
+	}
+	command, args := args[0], args[1:]
+	flags := flag.NewFlagSet("migrate "+command, flag.ContinueOnError)
+	dryRun := flags.Bool("dry_run", false, "Apply the pending migrations in a transaction that is rolled back.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	url := config.ConfigInstance.CacheStoreURL()
+	path, ok := strings.CutPrefix(url, "sqlite://")
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Migrations only apply to the sqlite cache database, please enable CACHE without a CACHE_URL of another store.")
+		return 1
+	}
+	db, err := cache.OpenDB(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Open cache database failed:", err)
+		return 1
+	}
+	defer db.Close()
+
+	switch command {
+	case "status":
+		states, err := migrate.Status(db)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Read migration status failed:", err)
+			return 1
+		}
+		fmt.Println("Database:", path)
+		for _, state := range states {
+			applied := "pending"
+			if state.AppliedAt != 0 {
+				applied = "applied " + time.Unix(state.AppliedAt, 0).Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-45s %s\n", state.Version, state.Name, applied)
+		}
+	case "up":
+		applied, err := migrate.Up(db, *dryRun)
+		for _, migration := range applied {
+			if *dryRun {
+				fmt.Printf("Would apply %d: %s\n", migration.Version, migration.Name)
+			} else {
+				fmt.Printf("Applied %d: %s\n", migration.Version, migration.Name)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Migration failed:", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("The database is up to date.")
+		} else if *dryRun {
+			fmt.Println("Dry run succeeded, nothing was changed.")
+		}
+	default:
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,139 @@
+// Package migrate keeps the schema of the sqlite cache database up to date. The applied
+// migrations are recorded in the schema_version table, pending ones are applied in order.
+package migrate
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"copilot-gpt4-service/log"
+)
+
+// Migration is a forward change of the schema. Migrations are never edited once released,
+// a change is made by appending a new one.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sqlx.Tx) error
+}
+
+// Exec returns the Up of a migration that runs the statements.
+func Exec(statements string) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// State of a migration in a database, AppliedAt is 0 if it is pending.
+type State struct {
+	Migration
+	AppliedAt int64 `db:"applied_at"`
+}
+
+// Create the table recording the applied migrations, in the database or a transaction.
+func createVersionTable(db sqlx.Execer) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version(
+			version INTEGER PRIMARY KEY,
+			name TEXT DEFAULT '',
+			applied_at INTEGER DEFAULT 0
+		)
+	`)
+	return err
+}
+
+// Status returns the state of every migration, in order. The database is only read, every
+// migration is pending if the schema_version table does not exist yet.
+func Status(db *sqlx.DB) ([]State, error) {
+	var tables int
+	if err := db.Get(&tables, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'"); err != nil {
+		return nil, err
+	}
+	var applied []struct {
+		Version   int   `db:"version"`
+		AppliedAt int64 `db:"applied_at"`
+	}
+	if tables > 0 {
+		if err := db.Select(&applied, "SELECT version, applied_at FROM schema_version"); err != nil {
+			return nil, err
+		}
+	}
+	appliedAt := make(map[int]int64, len(applied))
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	states := make([]State, 0, len(Migrations))
+	for _, migration := range Migrations {
+		states = append(states, State{Migration: migration, AppliedAt: appliedAt[migration.Version]})
+	}
+	return states, nil
+}
+
+// Up applies the pending migrations in order, each in its own transaction, and returns them.
+// With dryRun, they are applied in a single transaction which is rolled back, to check that
+// they would succeed.
+func Up(db *sqlx.DB, dryRun bool) ([]Migration, error) {
+	states, err := Status(db)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]Migration, 0)
+	for _, state := range states {
+		if state.AppliedAt == 0 {
+			pending = append(pending, state.Migration)
+		}
+	}
+	if len(pending) == 0 {
+		return pending, nil
+	}
+
+	if dryRun {
+		tx, err := db.Beginx()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		if err := createVersionTable(tx); err != nil {
+			return nil, err
+		}
+		for _, migration := range pending {
+			if err := apply(tx, migration); err != nil {
+				return nil, err
+			}
+		}
+		return pending, nil
+	}
+
+	if err := createVersionTable(db); err != nil {
+		return nil, err
+	}
+	for i, migration := range pending {
+		tx, err := db.Beginx()
+		if err != nil {
+			return pending[:i], err
+		}
+		if err := apply(tx, migration); err != nil {
+			tx.Rollback()
+			return pending[:i], err
+		}
+		if err := tx.Commit(); err != nil {
+			return pending[:i], err
+		}
+		log.ZLog.Log.Info().Msgf("Applied migration %d: %s", migration.Version, migration.Name)
+	}
+	return pending, nil
+}
+
+// Apply the migration and record it.
+func apply(tx *sqlx.Tx, migration Migration) error {
+	if err := migration.Up(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+	}
+	_, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		migration.Version, migration.Name, time.Now().Unix())
+	return err
+}
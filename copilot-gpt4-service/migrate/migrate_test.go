@@ -0,0 +1,116 @@
+package migrate
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+
+	"copilot-gpt4-service/log"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+func openDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Connect("sqlite", filepath.Join(t.TempDir(), "cache.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func pending(t *testing.T, db *sqlx.DB) int {
+	t.Helper()
+	states, err := Status(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, state := range states {
+		if state.AppliedAt == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func TestUpFresh(t *testing.T) {
+	db := openDB(t)
+	applied, err := Up(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) || pending(t, db) != 0 {
+		t.Fatalf("expected every migration to be applied, applied %d", len(applied))
+	}
+	if applied, err = Up(db, false); err != nil || len(applied) != 0 {
+		t.Fatalf("expected nothing to apply the second time, applied %d, err %v", len(applied), err)
+	}
+}
+
+// A database of an older release keeps its cached tokens, the missing columns are added.
+func TestUpLegacy(t *testing.T) {
+	db := openDB(t)
+	db.MustExec("CREATE TABLE cache(app_token TEXT PRIMARY KEY, c_token TEXT, expires_at INTEGER)")
+	db.MustExec("INSERT INTO cache VALUES ('ghu_old', 'c_old', 42)")
+
+	if _, err := Up(db, false); err != nil {
+		t.Fatal(err)
+	}
+	var item struct {
+		CToken      string `db:"c_token"`
+		ExpiresAt   int64  `db:"expires_at"`
+		MachineID   string `db:"vscode_machineid"`
+		LastTouched int64  `db:"last_touched"`
+	}
+	if err := db.Get(&item, "SELECT c_token, expires_at, vscode_machineid, last_touched FROM cache WHERE app_token = 'ghu_old'"); err != nil {
+		t.Fatalf("cached token lost: %v", err)
+	}
+	if item.CToken != "c_old" || item.ExpiresAt != 42 || item.MachineID != "" || item.LastTouched != 0 {
+		t.Fatalf("unexpected item after migration: %+v", item)
+	}
+}
+
+func TestUpDryRun(t *testing.T) {
+	db := openDB(t)
+	applied, err := Up(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) || pending(t, db) != len(Migrations) {
+		t.Fatalf("dry run changed the database, applied %d", len(applied))
+	}
+	var tables int
+	if err := db.Get(&tables, "SELECT COUNT(*) FROM sqlite_master WHERE name IN ('cache', 'schema_version')"); err != nil || tables != 0 {
+		t.Fatalf("dry run created %d tables, %v", tables, err)
+	}
+}
+
+// The status of a database that was never migrated is read without creating anything.
+func TestStatusReadOnly(t *testing.T) {
+	db := openDB(t)
+	if count := pending(t, db); count != len(Migrations) {
+		t.Fatalf("expected every migration to be pending, %d are", count)
+	}
+	var tables int
+	if err := db.Get(&tables, "SELECT COUNT(*) FROM sqlite_master"); err != nil || tables != 0 {
+		t.Fatalf("status created %d tables, %v", tables, err)
+	}
+}
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, migration := range Migrations {
+		if migration.Version != i+1 {
+			t.Fatalf("migration %q has version %d, expected %d", migration.Name, migration.Version, i+1)
+		}
+	}
+}
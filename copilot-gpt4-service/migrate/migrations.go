@@ -0,0 +1,85 @@
+package migrate
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// Migrations of the cache database, in order. The tables of databases created before the
+// migrations were introduced already exist, so every table is created only if not exists.
+var Migrations = []Migration{
+	{1, "create the cache table", Exec(`
+		CREATE TABLE IF NOT EXISTS cache(
+			app_token TEXT PRIMARY KEY,
+			c_token TEXT DEFAULT '',
+			expires_at INTEGER DEFAULT 0,
+			vscode_machineid TEXT DEFAULT '',
+			vscode_sessionid TEXT DEFAULT '',
+			session_expires_at INTEGER DEFAULT 0,
+			last_touched INTEGER DEFAULT 0
+		)
+	`)},
+	{2, "add the session columns to the cache table", addColumns("cache", []column{
+		{"vscode_machineid", "TEXT DEFAULT ''"},
+		{"vscode_sessionid", "TEXT DEFAULT ''"},
+		{"session_expires_at", "INTEGER DEFAULT 0"},
+		{"last_touched", "INTEGER DEFAULT 0"},
+	})},
+	{3, "create the api_keys table", Exec(`
+		CREATE TABLE IF NOT EXISTS api_keys(
+			id TEXT PRIMARY KEY,
+			name TEXT DEFAULT '',
+			key_hash TEXT UNIQUE NOT NULL,
+			key_prefix TEXT DEFAULT '',
+			endpoints TEXT DEFAULT '',
+			models TEXT DEFAULT '',
+			created_at INTEGER DEFAULT 0,
+			last_used_at INTEGER DEFAULT 0,
+			expires_at INTEGER DEFAULT 0,
+			revoked_at INTEGER DEFAULT 0
+		)
+	`)},
+	{4, "create the usage table", Exec(`
+		CREATE TABLE IF NOT EXISTS usage(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at INTEGER DEFAULT 0,
+			identity TEXT DEFAULT '',
+			key_id TEXT DEFAULT '',
+			endpoint TEXT DEFAULT '',
+			model TEXT DEFAULT '',
+			stream INTEGER DEFAULT 0,
+			prompt_tokens INTEGER DEFAULT 0,
+			completion_tokens INTEGER DEFAULT 0,
+			latency_ms INTEGER DEFAULT 0,
+			status INTEGER DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS usage_created_at ON usage(created_at);
+	`)},
+}
+
+type column struct {
+	name       string
+	definition string
+}
+
+// addColumns returns the Up of a migration that adds the columns the table is missing.
+func addColumns(table string, columns []column) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		var existing []string
+		if err := tx.Select(&existing, "SELECT name FROM pragma_table_info(?)", table); err != nil {
+			return err
+		}
+		exists := make(map[string]bool, len(existing))
+		for _, name := range existing {
+			exists[name] = true
+		}
+		for _, c := range columns {
+			if exists[c.name] {
+				continue
+			}
+			if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + c.name + " " + c.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"copilot-gpt4-service/config"
+	"copilot-gpt4-service/metrics"
+	"copilot-gpt4-service/models"
+	"copilot-gpt4-service/openai"
+	"copilot-gpt4-service/tracing"
+	"copilot-gpt4-service/transport"
+	"copilot-gpt4-service/utils"
+)
+
+// Longest models catalog read from upstream.
+const maxCatalogBody = 4 << 20
+
+// Whether the status of the token exchange rejects the token of the caller, rather than being
+// a failure of GitHub. Too many requests are a failure of GitHub, the fetch backs off.
+func callerStatus(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
+
+// Fetch the models catalog of the GitHub Copilot API with the Copilot token of appToken.
+// status is set to the upstream status of the fetch, for the pooled account to be released with.
+func fetchCatalog(appToken string, status *int) models.Fetcher {
+	return func(ctx context.Context) ([]models.Model, error) {
+		_, statusCode, errorInfo := utils.GetAuthorizationFromToken(ctx, appToken)
+		if len(errorInfo) != 0 {
+			*status = statusCode
+			err := openai.UpstreamError(statusCode, []byte(errorInfo))
+			if callerStatus(statusCode) {
+				return nil, fmt.Errorf("%w: %w", models.ErrCaller, err)
+			}
+			return nil, err
+		}
+
+		url := config.ConfigInstance.CopilotAPIURL("/models")
+		ctx, span := tracing.Start(ctx, "copilot.models", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			semconv.HTTPRequestMethodGet, semconv.URLFull(url)))
+		defer span.End()
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		for k, v := range createHeaders(ctx, appToken, false) {
+			req.Header.Set(k, v)
+		}
+		resp, err := transport.ClientInstance.Do(req)
+		if err != nil {
+			metrics.UpstreamError(metrics.EndpointModels, 0)
+			return nil, err
+		}
+		defer resp.Body.Close()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		*status = resp.StatusCode
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxCatalogBody))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			metrics.UpstreamError(metrics.EndpointModels, resp.StatusCode)
+			err := fmt.Errorf("status %d: %s", resp.StatusCode, openai.UpstreamError(resp.StatusCode, body).Message)
+			if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				return nil, fmt.Errorf("%w: %w", models.ErrCaller, err)
+			}
+			return nil, err
+		}
+		return models.ParseCatalog(body, time.Now().Unix())
+	}
+}
+
+// Return the models the caller may see. The catalog is fetched with the Copilot token of the
+// caller when it is stale, a caller without one is served the catalog as it is. The models
+// an API key is not allowed to use are left out.
+func callerModels(c *gin.Context) []models.Model {
+	var fetch models.Fetcher
+	upstreamStatus := 0
+	if appToken, ok := utils.GetAuthorization(c); ok {
+		defer func() { utils.ReleaseAuthorization(c, upstreamStatus) }()
+		fetch = fetchCatalog(appToken, &upstreamStatus)
+	}
+	list := models.CatalogInstance.List(c.Request.Context(), fetch)
+	if key := utils.GetAPIKey(c); key != nil {
+		allowed := make([]models.Model, 0, len(list))
+		for _, model := range list {
+			if key.AllowsModel(model.ID) {
+				allowed = append(allowed, model)
+			}
+		}
+		list = allowed
+	}
+	return list
+}
+
+// List the models of GitHub Copilot and the configured aliases.
+func listModels(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   callerModels(c),
+	})
+}
+
+// Return a model or an alias with its context window and capabilities.
+func getModel(c *gin.Context) {
+	id := c.Param("id")
+	for _, model := range callerModels(c) {
+		if model.ID == id {
+			c.JSON(http.StatusOK, model)
+			return
+		}
+	}
+	e := openai.NewError(http.StatusNotFound, fmt.Sprintf("The model '%s' does not exist", id))
+	param := "model"
+	e.Param, e.Code = &param, "model_not_found"
+	respondWithOpenAIError(c, e)
+}
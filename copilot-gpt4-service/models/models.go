@@ -0,0 +1,316 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"copilot-gpt4-service/log"
+)
+
+// Wait before fetching the catalog again after a failed fetch, the previous catalog or the
+// static list is served meanwhile.
+const fetchRetryInterval = time.Minute
+
+// Owner of the models of the static list and of the catalog entries without a vendor.
+const defaultOwner = "github-copilot"
+
+// Capabilities of a model.
+type Capabilities struct {
+	Chat       bool `json:"chat"`
+	Embeddings bool `json:"embeddings"`
+	Streaming  bool `json:"streaming"`
+	Tools      bool `json:"tools"`
+	Vision     bool `json:"vision"`
+}
+
+// Model is an entry of /v1/models, in the format of the OpenAI API with the details of the
+// GitHub Copilot catalog. Root is the model an alias stands for, the model itself otherwise.
+type Model struct {
+	ID              string       `json:"id"`
+	Object          string       `json:"object"`
+	Created         int64        `json:"created"`
+	OwnedBy         string       `json:"owned_by"`
+	Root            string       `json:"root"`
+	Name            string       `json:"name,omitempty"`
+	Version         string       `json:"version,omitempty"`
+	ContextWindow   int          `json:"context_window,omitempty"`
+	MaxOutputTokens int          `json:"max_output_tokens,omitempty"`
+	Capabilities    Capabilities `json:"capabilities"`
+}
+
+// The details of the well known models, used for the static list. The catalog of upstream
+// has its own.
+var knownModels = map[string]Model{
+	"gpt-4o":                 {Name: "GPT-4o", ContextWindow: 128000, MaxOutputTokens: 4096, Capabilities: Capabilities{Chat: true, Streaming: true, Tools: true, Vision: true}},
+	"gpt-4o-mini":            {Name: "GPT-4o mini", ContextWindow: 128000, MaxOutputTokens: 4096, Capabilities: Capabilities{Chat: true, Streaming: true, Tools: true, Vision: true}},
+	"gpt-4":                  {Name: "GPT-4", ContextWindow: 32768, MaxOutputTokens: 4096, Capabilities: Capabilities{Chat: true, Streaming: true, Tools: true}},
+	"gpt-3.5-turbo":          {Name: "GPT 3.5 Turbo", ContextWindow: 16384, MaxOutputTokens: 4096, Capabilities: Capabilities{Chat: true, Streaming: true, Tools: true}},
+	"text-embedding-3-small": {Name: "Embedding V3 small", ContextWindow: 8191, Capabilities: Capabilities{Embeddings: true}},
+	"text-embedding-ada-002": {Name: "Embedding V2 Ada", ContextWindow: 8191, Capabilities: Capabilities{Embeddings: true}},
+}
+
+// Create the entry of a model that is not in the catalog, with its details if it is well known.
+// A model that is not known is assumed to be a chat model.
+func describe(id string, created int64) Model {
+	model, ok := knownModels[id]
+	if !ok {
+		model.Capabilities = Capabilities{Chat: true, Streaming: true}
+		if strings.Contains(id, "embedding") {
+			model.Capabilities = Capabilities{Embeddings: true}
+		}
+	}
+	model.ID, model.Root = id, id
+	model.Object = "model"
+	model.Created = created
+	model.OwnedBy = defaultOwner
+	return model
+}
+
+// Split the comma separated model list, dropping empty entries and duplicates.
+func Names(list string) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// Parse the comma separated aliases, alias=model, e.g. gpt-4=gpt-4o. Invalid entries are
+// reported and skipped.
+func ParseAliases(list string) map[string]string {
+	aliases := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		alias, model, ok := strings.Cut(entry, "=")
+		alias, model = strings.TrimSpace(alias), strings.TrimSpace(model)
+		if !ok || alias == "" || model == "" || alias == model {
+			log.ZLog.Log.Warn().Msgf("Invalid model alias %q, expected alias=model", entry)
+			continue
+		}
+		aliases[alias] = model
+	}
+	return aliases
+}
+
+// Parse the models catalog of the GitHub Copilot API, GET /models.
+func ParseCatalog(body []byte, created int64) ([]Model, error) {
+	var catalog struct {
+		Data []struct {
+			ID           string `json:"id"`
+			Name         string `json:"name"`
+			Vendor       string `json:"vendor"`
+			Version      string `json:"version"`
+			Capabilities struct {
+				Type   string `json:"type"`
+				Limits struct {
+					MaxContextWindowTokens int             `json:"max_context_window_tokens"`
+					MaxOutputTokens        int             `json:"max_output_tokens"`
+					Vision                 json.RawMessage `json:"vision"`
+				} `json:"limits"`
+				Supports struct {
+					Streaming bool `json:"streaming"`
+					ToolCalls bool `json:"tool_calls"`
+					Vision    bool `json:"vision"`
+				} `json:"supports"`
+			} `json:"capabilities"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &catalog); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	models := make([]Model, 0, len(catalog.Data))
+	for _, entry := range catalog.Data {
+		if entry.ID == "" || seen[entry.ID] {
+			continue
+		}
+		seen[entry.ID] = true
+		owner := strings.ToLower(entry.Vendor)
+		if owner == "" {
+			owner = defaultOwner
+		}
+		capabilities := entry.Capabilities
+		models = append(models, Model{
+			ID:              entry.ID,
+			Object:          "model",
+			Created:         created,
+			OwnedBy:         owner,
+			Root:            entry.ID,
+			Name:            entry.Name,
+			Version:         entry.Version,
+			ContextWindow:   capabilities.Limits.MaxContextWindowTokens,
+			MaxOutputTokens: capabilities.Limits.MaxOutputTokens,
+			Capabilities: Capabilities{
+				Chat:       capabilities.Type == "chat",
+				Embeddings: capabilities.Type == "embeddings",
+				Streaming:  capabilities.Supports.Streaming,
+				Tools:      capabilities.Supports.ToolCalls,
+				Vision:     capabilities.Supports.Vision || len(capabilities.Limits.Vision) > 0,
+			},
+		})
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("the models catalog is empty")
+	}
+	return models, nil
+}
+
+// Fetcher fetches the models catalog of upstream.
+type Fetcher func(ctx context.Context) ([]Model, error)
+
+// ErrCaller is wrapped by the errors of a fetch that are due to the caller rather than to
+// upstream, e.g. a token GitHub does not accept. They do not delay the fetch of the next caller.
+var ErrCaller = errors.New("the caller is not allowed to fetch the models catalog")
+
+// Catalog serves the models of upstream, fetched again once the previous catalog is older than
+// the TTL, and the aliases of the configuration. The static list is served in offline mode and
+// until a catalog could be fetched.
+type Catalog struct {
+	ttl     time.Duration
+	offline bool
+	static  []Model
+	aliases map[string]string
+	group   singleflight.Group
+
+	mu        sync.Mutex
+	fetched   []Model
+	nextFetch time.Time
+}
+
+// CatalogInstance is a global variable that is used to access the models catalog, created by
+// the service once the configuration is loaded.
+var CatalogInstance *Catalog
+
+// Create a new Catalog instance.
+func NewCatalog(ttl time.Duration, offline bool, static []string, aliases map[string]string) *Catalog {
+	created := time.Now().Unix()
+	c := &Catalog{ttl: ttl, offline: offline, aliases: aliases}
+	for _, id := range static {
+		c.static = append(c.static, describe(id, created))
+	}
+	return c
+}
+
+// Return the models of upstream, fetched with fetch if the catalog is stale. nil fetch, e.g.
+// for a caller without a Copilot token, serves the catalog as it is.
+func (c *Catalog) models(ctx context.Context, fetch Fetcher) []Model {
+	if c.offline {
+		return c.static
+	}
+	c.mu.Lock()
+	fetched, stale := c.fetched, !time.Now().Before(c.nextFetch)
+	c.mu.Unlock()
+	if stale && fetch != nil {
+		// The fetch outlives the caller that started it, the other callers still wait on it
+		ctx = context.WithoutCancel(ctx)
+		value, _, _ := c.group.Do("catalog", func() (interface{}, error) {
+			models, err := fetch(ctx)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if errors.Is(err, ErrCaller) {
+				log.ZLog.Log.Debug().Err(err).Msg("Fetching the github copilot models catalog failed for the caller")
+				return c.fetched, nil
+			}
+			if err != nil {
+				log.ZLog.Log.Warn().Err(err).Msgf("Fetching the github copilot models catalog failed, retrying not before %s", fetchRetryInterval)
+				c.nextFetch = time.Now().Add(fetchRetryInterval)
+				return c.fetched, nil
+			}
+			log.ZLog.Log.Debug().Msgf("Fetched the github copilot models catalog, %d models", len(models))
+			c.fetched, c.nextFetch = models, time.Now().Add(c.ttl)
+			return models, nil
+		})
+		fetched = value.([]Model)
+	}
+	if len(fetched) == 0 {
+		return c.static
+	}
+	return fetched
+}
+
+// List the models of upstream and the aliases. An alias replaces the model of upstream with
+// its name, since the requests for it are sent as its model.
+func (c *Catalog) List(ctx context.Context, fetch Fetcher) []Model {
+	models := c.models(ctx, fetch)
+	list := make([]Model, 0, len(models)+len(c.aliases))
+	byID := make(map[string]Model, len(models))
+	for _, model := range models {
+		byID[model.ID] = model
+		if _, ok := c.aliases[model.ID]; !ok {
+			list = append(list, model)
+		}
+	}
+	for _, alias := range sortedKeys(c.aliases) {
+		list = append(list, c.alias(alias, byID))
+	}
+	return list
+}
+
+// Known reports whether the id is an alias, a model of the catalog or of the static list, or
+// a well known model.
+func (c *Catalog) Known(id string) bool {
+	if _, ok := c.aliases[id]; ok {
+		return true
+	}
+	if _, ok := knownModels[id]; ok {
+		return true
+	}
+	for _, model := range c.static {
+		if model.ID == id {
+			return true
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, model := range c.fetched {
+		if model.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the model the id stands for, the id itself if it is not an alias.
+func (c *Catalog) Resolve(id string) string {
+	if model, ok := c.aliases[id]; ok {
+		return model
+	}
+	return id
+}
+
+// Create the entry of an alias, with the details of its model.
+func (c *Catalog) alias(alias string, byID map[string]Model) Model {
+	target := c.aliases[alias]
+	model, ok := byID[target]
+	if !ok {
+		model = describe(target, time.Now().Unix())
+	}
+	model.ID, model.Root = alias, target
+	return model
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"copilot-gpt4-service/log"
+)
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestParseCatalog(t *testing.T) {
+	body := []byte(`{"object":"list","data":[
+		{"id":"gpt-4o","name":"GPT-4o","vendor":"Azure OpenAI","version":"gpt-4o-2024-05-13","capabilities":{"type":"chat",
+			"limits":{"max_context_window_tokens":128000,"max_output_tokens":4096,"vision":{"max_prompt_images":1}},
+			"supports":{"streaming":true,"tool_calls":true}}},
+		{"id":"gpt-4o","name":"duplicate"},
+		{"id":"text-embedding-3-small","capabilities":{"type":"embeddings","limits":{"max_inputs":512}}}]}`)
+	models, err := ParseCatalog(body, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 2 {
+		t.Fatalf("expected 2 models, got %+v", models)
+	}
+	chat := models[0]
+	if chat.ID != "gpt-4o" || chat.Root != "gpt-4o" || chat.Object != "model" || chat.Created != 42 || chat.OwnedBy != "azure openai" ||
+		chat.ContextWindow != 128000 || chat.MaxOutputTokens != 4096 ||
+		chat.Capabilities != (Capabilities{Chat: true, Streaming: true, Tools: true, Vision: true}) {
+		t.Fatalf("unexpected chat model: %+v", chat)
+	}
+	embeddings := models[1]
+	if embeddings.OwnedBy != defaultOwner || embeddings.Capabilities != (Capabilities{Embeddings: true}) {
+		t.Fatalf("unexpected embeddings model: %+v", embeddings)
+	}
+
+	for _, invalid := range []string{`{"data":[]}`, `not json`} {
+		if _, err := ParseCatalog([]byte(invalid), 0); err == nil {
+			t.Fatalf("expected the catalog %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	aliases := ParseAliases(" gpt-4 = gpt-4o ,broken,=gpt-4o,same=same,,gpt-3.5-turbo=gpt-4o-mini")
+	if len(aliases) != 2 || aliases["gpt-4"] != "gpt-4o" || aliases["gpt-3.5-turbo"] != "gpt-4o-mini" {
+		t.Fatalf("unexpected aliases: %v", aliases)
+	}
+}
+
+func TestCatalogRefresh(t *testing.T) {
+	fetches := 0
+	var fail bool
+	fetch := func(ctx context.Context) ([]Model, error) {
+		fetches++
+		if fail {
+			return nil, errors.New("unreachable")
+		}
+		return []Model{{ID: "fetched"}}, nil
+	}
+	catalog := NewCatalog(time.Hour, false, []string{"static", "gpt-4"}, map[string]string{"alias": "fetched", "gpt-4": "gpt-4o"})
+	ids := func(models []Model) string {
+		s := ""
+		for _, model := range models {
+			s += model.ID + " "
+		}
+		return s
+	}
+
+	if list := ids(catalog.List(context.Background(), nil)); list != "static alias gpt-4 " {
+		t.Fatalf("expected the static list before a fetch, got %s", list)
+	}
+	for i := 0; i < 2; i++ {
+		if list := ids(catalog.List(context.Background(), fetch)); list != "fetched alias gpt-4 " {
+			t.Fatalf("unexpected models: %s", list)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected the catalog to be kept for its TTL, got %d fetches", fetches)
+	}
+
+	// once stale, a failed fetch keeps the previous catalog
+	catalog.nextFetch = time.Time{}
+	fail = true
+	if list := ids(catalog.List(context.Background(), fetch)); list != "fetched alias gpt-4 " || fetches != 2 {
+		t.Fatalf("expected the previous catalog after a failed fetch, got %s after %d fetches", list, fetches)
+	}
+	// and is not retried before the retry interval
+	catalog.List(context.Background(), fetch)
+	if fetches != 2 {
+		t.Fatalf("expected the failed fetch to back off, got %d fetches", fetches)
+	}
+
+	// a caller that is not allowed to fetch does not delay the fetch of the next one
+	catalog.nextFetch = time.Time{}
+	callerFetch := func(ctx context.Context) ([]Model, error) {
+		fetches++
+		return nil, fmt.Errorf("%w: bad credentials", ErrCaller)
+	}
+	if list := ids(catalog.List(context.Background(), callerFetch)); list != "fetched alias gpt-4 " || fetches != 3 {
+		t.Fatalf("expected the previous catalog after a failed fetch, got %s after %d fetches", list, fetches)
+	}
+	fail = false
+	catalog.List(context.Background(), fetch)
+	if fetches != 4 {
+		t.Fatalf("expected the catalog to be fetched after an error of the caller, got %d fetches", fetches)
+	}
+
+	if catalog.Resolve("gpt-4") != "gpt-4o" || catalog.Resolve("gpt-4o") != "gpt-4o" {
+		t.Fatal("unexpected alias resolution")
+	}
+}
+
+func TestCatalogKnown(t *testing.T) {
+	catalog := NewCatalog(time.Hour, false, []string{"static"}, map[string]string{"alias": "fetched"})
+	for id, want := range map[string]bool{"static": true, "alias": true, "gpt-4o": true, "fetched": false, "made-up": false, "": false} {
+		if got := catalog.Known(id); got != want {
+			t.Errorf("Known(%q) = %v before the fetch, want %v", id, got, want)
+		}
+	}
+	catalog.List(context.Background(), func(ctx context.Context) ([]Model, error) {
+		return []Model{{ID: "fetched"}}, nil
+	})
+	if !catalog.Known("fetched") || catalog.Known("made-up") {
+		t.Fatal("the fetched catalog is not known")
+	}
+}
@@ -0,0 +1,380 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolCall is a tool invocation requested by the model. In streamed deltas only
+// the first fragment of a call carries the ID, type and function name, the
+// following ones append to the arguments of the call with the same index.
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+// Fields of a choice that the collector merges itself, every other field is kept as received.
+var mergedChoiceFields = map[string]bool{
+	"index":         true,
+	"delta":         true,
+	"message":       true,
+	"finish_reason": true,
+	"logprobs":      true,
+}
+
+// Fields of a message that are replaced by later deltas instead of being concatenated.
+var replacedMessageFields = map[string]bool{
+	"role": true,
+	"id":   true,
+	"type": true,
+	"name": true,
+}
+
+type collectedChoice struct {
+	extra        Object
+	message      Object
+	toolCalls    []*collectedCall
+	functionCall Object
+	finishReason json.RawMessage
+	logprobs     []json.RawMessage
+}
+
+type collectedCall struct {
+	index    int
+	call     Object
+	function Object
+}
+
+// Collector merges the chunks of a streamed chat completion into a single
+// chat.completion response. It also accepts a complete response, which is
+// treated as one chunk carrying full messages instead of deltas.
+type Collector struct {
+	base     Object
+	choices  map[int]*collectedChoice
+	usage    json.RawMessage
+	errEvent []byte
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		base:    Object{},
+		choices: make(map[int]*collectedChoice),
+	}
+}
+
+// DataLine extracts the JSON payload of a server-sent event line. It reports
+// false for blank lines, comments, other event fields and the [DONE] marker.
+func DataLine(line []byte) ([]byte, bool) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return nil, false
+	}
+	data := bytes.TrimSpace(line[len("data:"):])
+	if len(data) == 0 || bytes.Equal(data, []byte("[DONE]")) {
+		return nil, false
+	}
+	return data, true
+}
+
+// Collect reads the whole upstream body, which is either a single JSON
+// object or a stream of server-sent events.
+func (c *Collector) Collect(r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		if chunk, err := ParseObject(trimmed); err == nil {
+			c.Add(chunk)
+			return nil
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		data, ok := DataLine(scanner.Bytes())
+		if !ok {
+			continue
+		}
+		chunk, err := ParseObject(data)
+		if err != nil {
+			return err
+		}
+		c.Add(chunk)
+	}
+	return scanner.Err()
+}
+
+// Add merges a chunk into the collected response. An error event is kept apart, see ErrorEvent.
+func (c *Collector) Add(chunk Object) {
+	if chunk.Has("error") {
+		if c.errEvent == nil {
+			c.errEvent, _ = chunk.Marshal()
+		}
+		return
+	}
+	for key, value := range chunk {
+		switch key {
+		case "choices", "object":
+		case "usage":
+			if chunk.Has("usage") {
+				c.usage = value
+			}
+		default:
+			if !c.base.Has(key) {
+				c.base[key] = value
+			}
+		}
+	}
+
+	for _, item := range chunk.Objects("choices") {
+		index := item.Int("index")
+		choice, ok := c.choices[index]
+		if !ok {
+			choice = &collectedChoice{extra: Object{}, message: Object{}}
+			c.choices[index] = choice
+		}
+		choice.add(item)
+	}
+}
+
+func (choice *collectedChoice) add(item Object) {
+	for key, value := range item {
+		if !mergedChoiceFields[key] && !choice.extra.Has(key) {
+			choice.extra[key] = value
+		}
+	}
+
+	var delta Object
+	if item.Has("delta") {
+		_ = item.Get("delta", &delta)
+	} else {
+		_ = item.Get("message", &delta)
+	}
+
+	for key, value := range delta {
+		switch key {
+		case "tool_calls":
+			var calls []Object
+			_ = delta.Get(key, &calls)
+			for i, call := range calls {
+				choice.addToolCall(i, call)
+			}
+		case "function_call":
+			var call Object
+			if delta.Get(key, &call) == nil && call != nil {
+				if choice.functionCall == nil {
+					choice.functionCall = Object{}
+				}
+				mergeFields(choice.functionCall, call)
+			}
+		default:
+			mergeField(choice.message, key, value)
+		}
+	}
+
+	if item.Has("finish_reason") {
+		choice.finishReason = item["finish_reason"]
+	}
+	var logprobs struct {
+		Content []json.RawMessage `json:"content"`
+	}
+	if item.Has("logprobs") && item.Get("logprobs", &logprobs) == nil {
+		choice.logprobs = append(choice.logprobs, logprobs.Content...)
+	}
+}
+
+// addToolCall merges a streamed fragment of a tool call into the call with the same index.
+func (choice *collectedChoice) addToolCall(position int, call Object) {
+	index := position
+	if call.Has("index") {
+		index = call.Int("index")
+	}
+	var merged *collectedCall
+	for _, existing := range choice.toolCalls {
+		if existing.index == index {
+			merged = existing
+			break
+		}
+	}
+	if merged == nil {
+		merged = &collectedCall{index: index, call: Object{}, function: Object{}}
+		choice.toolCalls = append(choice.toolCalls, merged)
+	}
+	for key, value := range call {
+		switch key {
+		case "index":
+		case "function":
+			var function Object
+			if call.Get(key, &function) == nil {
+				mergeFields(merged.function, function)
+			}
+		default:
+			mergeField(merged.call, key, value)
+		}
+	}
+}
+
+func mergeFields(dst, src Object) {
+	for key, value := range src {
+		mergeField(dst, key, value)
+	}
+}
+
+// mergeField merges a field of a delta into the fields collected so far:
+// strings are concatenated (content, refusal, arguments, ...), arrays are
+// appended (annotations, ...) and anything else is replaced. Nulls never
+// override a value.
+func mergeField(dst Object, key string, value json.RawMessage) {
+	if !dst.Has(key) {
+		if _, ok := dst[key]; !ok || !bytes.Equal(bytes.TrimSpace(value), null) {
+			dst[key] = value
+		}
+		return
+	}
+	if bytes.Equal(bytes.TrimSpace(value), null) {
+		return
+	}
+	if !replacedMessageFields[key] {
+		var prefix, suffix string
+		if dst.Get(key, &prefix) == nil && json.Unmarshal(value, &suffix) == nil {
+			_ = dst.Set(key, prefix+suffix)
+			return
+		}
+		var head, tail []json.RawMessage
+		if dst.Get(key, &head) == nil && json.Unmarshal(value, &tail) == nil {
+			_ = dst.Set(key, append(head, tail...))
+			return
+		}
+	}
+	dst[key] = value
+}
+
+// Result returns the merged chat.completion response.
+func (c *Collector) Result() Object {
+	result := Object{}
+	for key, value := range c.base {
+		result[key] = value
+	}
+	_ = result.Set("object", "chat.completion")
+
+	indexes := make([]int, 0, len(c.choices))
+	for index := range c.choices {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	choices := make([]Object, 0, len(indexes))
+	for _, index := range indexes {
+		choices = append(choices, c.choices[index].result(index))
+	}
+	_ = result.Set("choices", choices)
+
+	if c.usage != nil {
+		result["usage"] = c.usage
+	}
+	return result
+}
+
+func (choice *collectedChoice) result(index int) Object {
+	item := Object{}
+	for key, value := range choice.extra {
+		item[key] = value
+	}
+	_ = item.Set("index", index)
+
+	message := Object{}
+	for key, value := range choice.message {
+		message[key] = value
+	}
+	_ = message.SetDefault("role", "assistant")
+	calls := len(choice.toolCalls) > 0 || choice.functionCall != nil
+	if !message.Has("content") && !calls {
+		_ = message.Set("content", "")
+	} else if calls && (!message.Has("content") || bytes.Equal(message["content"], []byte(`""`))) {
+		message["content"] = json.RawMessage(null)
+	}
+	if len(choice.toolCalls) > 0 {
+		calls := make([]Object, 0, len(choice.toolCalls))
+		for _, call := range choice.toolCalls {
+			calls = append(calls, call.result())
+		}
+		_ = message.Set("tool_calls", calls)
+	}
+	if choice.functionCall != nil {
+		function := Object{}
+		for key, value := range choice.functionCall {
+			function[key] = value
+		}
+		_ = function.SetDefault("arguments", "")
+		_ = message.Set("function_call", function)
+	}
+	_ = item.Set("message", message)
+
+	if choice.finishReason != nil {
+		item["finish_reason"] = choice.finishReason
+	} else {
+		item["finish_reason"] = json.RawMessage(null)
+	}
+	if len(choice.logprobs) > 0 {
+		_ = item.Set("logprobs", map[string]interface{}{"content": choice.logprobs})
+	} else {
+		item["logprobs"] = json.RawMessage(null)
+	}
+	return item
+}
+
+func (call *collectedCall) result() Object {
+	item := Object{}
+	for key, value := range call.call {
+		item[key] = value
+	}
+	function := Object{}
+	for key, value := range call.function {
+		function[key] = value
+	}
+	_ = function.SetDefault("arguments", "")
+	_ = item.Set("function", function)
+	return item
+}
+
+// ErrorEvent returns the first error event upstream sent instead of a chunk, e.g. when it
+// failed after the response started. The response is incomplete then.
+func (c *Collector) ErrorEvent() ([]byte, bool) {
+	return c.errEvent, c.errEvent != nil
+}
+
+// Usage returns the usage reported by upstream, if any chunk carried one.
+func (c *Collector) Usage() (Usage, bool) {
+	var usage Usage
+	if c.usage == nil || json.Unmarshal(c.usage, &usage) != nil {
+		return usage, false
+	}
+	return usage, true
+}
+
+// Texts returns the generated texts of every choice: contents, refusals, function names and arguments.
+func (c *Collector) Texts() []string {
+	texts := make([]string, 0, len(c.choices))
+	for _, choice := range c.choices {
+		texts = append(texts, choice.message.String("content"), choice.message.String("refusal"))
+		for _, call := range choice.toolCalls {
+			texts = append(texts, call.function.String("name"), call.function.String("arguments"))
+		}
+		if choice.functionCall != nil {
+			texts = append(texts, choice.functionCall.String("name"), choice.functionCall.String("arguments"))
+		}
+	}
+	return texts
+}
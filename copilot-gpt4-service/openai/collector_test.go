@@ -0,0 +1,160 @@
+package openai
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func collect(t *testing.T, body string) *Collector {
+	t.Helper()
+	c := NewCollector()
+	if err := c.Collect(strings.NewReader(body)); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	return c
+}
+
+func message(t *testing.T, result Object) map[string]interface{} {
+	t.Helper()
+	choices := result.Objects("choices")
+	if len(choices) != 1 {
+		t.Fatalf("unexpected choices: %d", len(choices))
+	}
+	var m map[string]interface{}
+	if err := choices[0].Get("message", &m); err != nil {
+		t.Fatalf("decode message: %v", err)
+	}
+	return m
+}
+
+func TestCollectorStreamKeepsUnknownFields(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"gpt-4","system_fingerprint":"fp","choices":[{"index":0,"delta":{"role":"assistant","content":""},"content_filter_results":{}}]}`,
+		``,
+		`data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":"Hel","refusal":null}}]}`,
+		`data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":"lo","annotations":[{"type":"url_citation","url":"https://a"}]}}]}`,
+		`data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"annotations":[{"type":"url_citation","url":"https://b"}]},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		`data: [DONE]`,
+	}, "\n")
+	result := collect(t, body).Result()
+
+	if result.String("object") != "chat.completion" || result.String("id") != "chatcmpl-1" || result.String("system_fingerprint") != "fp" {
+		t.Fatalf("unexpected envelope: %s", mustMarshal(t, result))
+	}
+	m := message(t, result)
+	if m["role"] != "assistant" || m["content"] != "Hello" {
+		t.Fatalf("unexpected message: %v", m)
+	}
+	if _, ok := m["refusal"]; !ok || m["refusal"] != nil {
+		t.Fatalf("refusal dropped: %v", m)
+	}
+	annotations, _ := m["annotations"].([]interface{})
+	if len(annotations) != 2 {
+		t.Fatalf("annotations not appended: %v", m["annotations"])
+	}
+	choice := result.Objects("choices")[0]
+	if choice.String("finish_reason") != "stop" || !choice.Has("content_filter_results") {
+		t.Fatalf("unexpected choice: %s", mustMarshal(t, choice))
+	}
+	if usage, ok := collect(t, body).Usage(); !ok || usage.TotalTokens != 5 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestCollectorStreamToolCalls(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"id":"1","choices":[{"index":0,"delta":{"role":"assistant","content":null,"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"weather","arguments":""}}]}}]}`,
+		`data: {"id":"1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+		`data: {"id":"1","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"time","arguments":"{}"}}]}}]}`,
+		`data: {"id":"1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]},"finish_reason":"tool_calls"}]}`,
+	}, "\n")
+	c := collect(t, body)
+	m := message(t, c.Result())
+	if m["content"] != nil {
+		t.Fatalf("content should be null: %v", m["content"])
+	}
+	want := []interface{}{
+		map[string]interface{}{"id": "call_a", "type": "function", "function": map[string]interface{}{"name": "weather", "arguments": `{"city":"Paris"}`}},
+		map[string]interface{}{"id": "call_b", "type": "function", "function": map[string]interface{}{"name": "time", "arguments": "{}"}},
+	}
+	if !reflect.DeepEqual(m["tool_calls"], want) {
+		t.Fatalf("unexpected tool calls: %v", m["tool_calls"])
+	}
+	texts := strings.Join(c.Texts(), "|")
+	if !strings.Contains(texts, `weather|{"city":"Paris"}`) || !strings.Contains(texts, "time|{}") {
+		t.Fatalf("unexpected texts: %q", texts)
+	}
+}
+
+func TestCollectorStreamFunctionCall(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"choices":[{"index":0,"delta":{"role":"assistant","function_call":{"name":"weather","arguments":""}}}]}`,
+		`data: {"choices":[{"index":0,"delta":{"function_call":{"arguments":"{}"}},"finish_reason":"function_call"}]}`,
+	}, "\n")
+	m := message(t, collect(t, body).Result())
+	want := map[string]interface{}{"name": "weather", "arguments": "{}"}
+	if m["content"] != nil || !reflect.DeepEqual(m["function_call"], want) {
+		t.Fatalf("unexpected message: %v", m)
+	}
+}
+
+func TestCollectorCompleteResponse(t *testing.T) {
+	body := `{"id":"chatcmpl-2","object":"chat.completion","model":"gpt-4","choices":[{"index":0,"message":{"role":"assistant","content":"Hi","refusal":null,"annotations":[],"audio":{"id":"a"}},"finish_reason":"stop","logprobs":null}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`
+	result := collect(t, body).Result()
+	m := message(t, result)
+	want := map[string]interface{}{
+		"role":        "assistant",
+		"content":     "Hi",
+		"refusal":     nil,
+		"annotations": []interface{}{},
+		"audio":       map[string]interface{}{"id": "a"},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("unexpected message: %v", m)
+	}
+	if !result.Has("usage") {
+		t.Fatal("usage dropped")
+	}
+}
+
+func TestCollectorErrorEvent(t *testing.T) {
+	body := `data: {"id":"4","choices":[{"index":0,"delta":{"content":"Hi"}}]}
+
+data: {"error":{"message":"upstream failed","code":"upstream_error"}}
+
+data: [DONE]`
+	c := collect(t, body)
+	event, ok := c.ErrorEvent()
+	if !ok {
+		t.Fatal("the error event is not reported")
+	}
+	if e, ok := ParseError(event); !ok || e.Message != "upstream failed" {
+		t.Fatalf("unexpected error event: %s", event)
+	}
+	if c.Result().Has("error") {
+		t.Fatal("the error event is merged into the result")
+	}
+
+	if _, ok := collect(t, `data: {"id":"5","choices":[]}`).ErrorEvent(); ok {
+		t.Fatal("an error event is reported for a stream without one")
+	}
+}
+
+func TestCollectorEmptyStream(t *testing.T) {
+	result := collect(t, `data: {"id":"3","choices":[{"index":0,"delta":{}}]}`).Result()
+	m := message(t, result)
+	if m["role"] != "assistant" || m["content"] != "" {
+		t.Fatalf("unexpected message: %v", m)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
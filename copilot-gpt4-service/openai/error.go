@@ -0,0 +1,141 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Types of the errors, as reported by the OpenAI API.
+const (
+	InvalidRequestError = "invalid_request_error"
+	AuthenticationError = "authentication_error"
+	PermissionError     = "permission_error"
+	NotFoundError       = "not_found_error"
+	RateLimitError      = "rate_limit_error"
+	ServerError         = "server_error"
+)
+
+// Longest upstream body kept as the message of an error that is not JSON.
+const maxErrorMessage = 1024
+
+// Error is an error in the format of the OpenAI API, sent as {"error": {...}} so that
+// the OpenAI clients raise a meaningful exception. Status is the HTTP status it is sent with.
+type Error struct {
+	Status  int         `json:"-"`
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Param   *string     `json:"param"`
+	Code    interface{} `json:"code"`
+}
+
+// Create an error sent with the status, its type and code follow from the status.
+func NewError(status int, message string) *Error {
+	e := &Error{Status: status, Message: message, Type: ErrorType(status)}
+	switch status {
+	case http.StatusUnauthorized:
+		e.Code = "invalid_api_key"
+	case http.StatusTooManyRequests:
+		e.Code = "rate_limit_exceeded"
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Marshal the error in its envelope, {"error": {...}}.
+func (e *Error) Marshal() ([]byte, error) {
+	return json.Marshal(struct {
+		Error *Error `json:"error"`
+	}{e})
+}
+
+// Return the type of the errors sent with the status.
+func ErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return AuthenticationError
+	case status == http.StatusForbidden:
+		return PermissionError
+	case status == http.StatusNotFound:
+		return NotFoundError
+	case status == http.StatusTooManyRequests:
+		return RateLimitError
+	case status >= 500:
+		return ServerError
+	default:
+		return InvalidRequestError
+	}
+}
+
+// Return the status the service responds with to an upstream error status. The errors of
+// the request are passed on, the failures of upstream are reported as a bad gateway,
+// unless they tell the client to retry later.
+func UpstreamStatus(status int) int {
+	switch {
+	case status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout:
+		return status
+	case status >= 500 || status < 400:
+		return http.StatusBadGateway
+	default:
+		return status
+	}
+}
+
+// Translate an upstream error response into an error of the service. The message, type,
+// param and code of the body are kept when they are found, a body that is not JSON is
+// the message itself.
+func UpstreamError(status int, body []byte) *Error {
+	status = UpstreamStatus(status)
+	e := NewError(status, "")
+	if upstream, ok := ParseError(body); ok {
+		e.Message = upstream.Message
+		if upstream.Type != "" {
+			e.Type = upstream.Type
+		}
+		if upstream.Param != nil {
+			e.Param = upstream.Param
+		}
+		if upstream.Code != nil {
+			e.Code = upstream.Code
+		}
+	} else if text := strings.TrimSpace(string(body)); text != "" && !json.Valid(body) {
+		if len(text) > maxErrorMessage {
+			text = text[:maxErrorMessage] + "..."
+		}
+		e.Message = text
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	return e
+}
+
+// Parse the error of a JSON body, in the format of the OpenAI API, {"error": {...}} or
+// {"error": "message"}, or of the GitHub API, {"message": "..."}.
+func ParseError(body []byte) (*Error, bool) {
+	var envelope struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(body), &envelope); err != nil {
+		return nil, false
+	}
+	if len(envelope.Error) > 0 && !bytes.Equal(envelope.Error, null) {
+		e := &Error{}
+		if json.Unmarshal(envelope.Error, e) == nil && e.Message != "" {
+			return e, true
+		}
+		var message string
+		if json.Unmarshal(envelope.Error, &message) == nil && message != "" {
+			return &Error{Message: message}, true
+		}
+	}
+	if envelope.Message != "" {
+		return &Error{Message: envelope.Message}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,98 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   Error
+	}{
+		{
+			name:   "openai error",
+			status: http.StatusBadRequest,
+			body:   `{"error":{"message":"context too long","type":"invalid_request_error","param":"messages","code":"context_length_exceeded"}}`,
+			want:   Error{Status: http.StatusBadRequest, Message: "context too long", Type: InvalidRequestError, Code: "context_length_exceeded"},
+		},
+		{
+			name:   "string error",
+			status: http.StatusTooManyRequests,
+			body:   `{"error":"slow down"}`,
+			want:   Error{Status: http.StatusTooManyRequests, Message: "slow down", Type: RateLimitError, Code: "rate_limit_exceeded"},
+		},
+		{
+			name:   "github error",
+			status: http.StatusUnauthorized,
+			body:   `{"message":"Bad credentials","documentation_url":"https://docs.github.com/rest"}`,
+			want:   Error{Status: http.StatusUnauthorized, Message: "Bad credentials", Type: AuthenticationError, Code: "invalid_api_key"},
+		},
+		{
+			name:   "plain text",
+			status: http.StatusInternalServerError,
+			body:   "upstream exploded\n",
+			want:   Error{Status: http.StatusBadGateway, Message: "upstream exploded", Type: ServerError},
+		},
+		{
+			name:   "empty body",
+			status: http.StatusServiceUnavailable,
+			want:   Error{Status: http.StatusServiceUnavailable, Message: "Service Unavailable", Type: ServerError},
+		},
+		{
+			name:   "unknown json",
+			status: http.StatusForbidden,
+			body:   `{"unexpected":true}`,
+			want:   Error{Status: http.StatusForbidden, Message: "Forbidden", Type: PermissionError},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := UpstreamError(test.status, []byte(test.body))
+			if e.Status != test.want.Status || e.Message != test.want.Message || e.Type != test.want.Type || e.Code != test.want.Code {
+				t.Fatalf("unexpected error: %+v, want %+v", *e, test.want)
+			}
+		})
+	}
+}
+
+func TestErrorMarshal(t *testing.T) {
+	data, err := NewError(http.StatusNotFound, "no such model").Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatal(err)
+	}
+	e := body["error"]
+	for _, field := range []string{"message", "type", "param", "code"} {
+		if _, ok := e[field]; !ok {
+			t.Fatalf("missing field %s: %s", field, data)
+		}
+	}
+	if e["message"] != "no such model" || e["type"] != NotFoundError || strings.Contains(string(data), "Status") {
+		t.Fatalf("unexpected error body: %s", data)
+	}
+}
+
+func TestUpstreamStatus(t *testing.T) {
+	for status, want := range map[int]int{
+		http.StatusBadRequest:          http.StatusBadRequest,
+		http.StatusUnauthorized:        http.StatusUnauthorized,
+		http.StatusTooManyRequests:     http.StatusTooManyRequests,
+		http.StatusInternalServerError: http.StatusBadGateway,
+		http.StatusBadGateway:          http.StatusBadGateway,
+		http.StatusServiceUnavailable:  http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:      http.StatusGatewayTimeout,
+		http.StatusFound:               http.StatusBadGateway,
+	} {
+		if got := UpstreamStatus(status); got != want {
+			t.Fatalf("UpstreamStatus(%d) = %d, want %d", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Object is a JSON object that keeps every field it was decoded with, so that
+// request and response bodies can be forwarded without dropping fields this
+// service does not know about.
+type Object map[string]json.RawMessage
+
+var null = []byte("null")
+
+// Read the JSON object from the reader. An empty body results in an empty object.
+func ReadObject(r io.Reader) (Object, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseObject(body)
+}
+
+// Parse the JSON object from the data. Empty data results in an empty object.
+func ParseObject(data []byte) (Object, error) {
+	o := Object{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return o, nil
+	}
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return nil, errors.New("json: body is not an object")
+	}
+	return o, nil
+}
+
+// Has reports whether the field is present and not null.
+func (o Object) Has(key string) bool {
+	raw, ok := o[key]
+	return ok && !bytes.Equal(bytes.TrimSpace(raw), null)
+}
+
+// Get decodes the field into v. A missing field leaves v untouched.
+func (o Object) Get(key string, v interface{}) error {
+	raw, ok := o[key]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Set overrides the field with the JSON encoding of v.
+func (o Object) Set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	o[key] = raw
+	return nil
+}
+
+// SetDefault sets the field only if it is missing or null.
+func (o Object) SetDefault(key string, v interface{}) error {
+	if o.Has(key) {
+		return nil
+	}
+	return o.Set(key, v)
+}
+
+// String returns the field as a string, or "" if it is not a string.
+func (o Object) String(key string) string {
+	var s string
+	if err := o.Get(key, &s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// Bool returns the field as a boolean, or false if it is not a boolean.
+func (o Object) Bool(key string) bool {
+	var b bool
+	if err := o.Get(key, &b); err != nil {
+		return false
+	}
+	return b
+}
+
+// Int returns the field as an integer, or 0 if it is not a number.
+func (o Object) Int(key string) int {
+	var n int
+	if err := o.Get(key, &n); err != nil {
+		return 0
+	}
+	return n
+}
+
+// Objects decodes the field as an array of objects, e.g. "choices" or "data".
+func (o Object) Objects(key string) []Object {
+	var items []Object
+	if err := o.Get(key, &items); err != nil {
+		return nil
+	}
+	return items
+}
+
+// Marshal the object back to JSON.
+func (o Object) Marshal() ([]byte, error) {
+	return json.Marshal(o)
+}
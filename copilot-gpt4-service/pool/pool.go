@@ -0,0 +1,182 @@
+package pool
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"copilot-gpt4-service/log"
+)
+
+// Strategy decides which account serves the next request.
+type Strategy string
+
+const (
+	RoundRobin        Strategy = "round_robin"
+	LeastRecentlyUsed Strategy = "lru"
+	LeastInFlight     Strategy = "least_inflight"
+	defaultStrategy            = RoundRobin
+)
+
+var ErrNoAccount = errors.New("no github copilot account in the pool")
+
+// PoolInstance is a global variable that is used to access the account pool, created by the
+// service once the configuration is loaded.
+var PoolInstance *Pool
+
+// Account is a GitHub Copilot Plugin Token in the pool.
+type Account struct {
+	ID            int
+	Token         string
+	inFlight      int
+	lastUsed      time.Time
+	cooldownUntil time.Time
+}
+
+// Pool hands out the GitHub Copilot accounts and takes failing ones out of rotation.
+type Pool struct {
+	mu       sync.Mutex
+	accounts []*Account
+	strategy Strategy
+	cooldown time.Duration
+	next     int
+}
+
+// Merge the single default token and the comma separated token list, dropping duplicates.
+func Tokens(token string, tokens string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, t := range append([]string{token}, strings.Split(tokens, ",")...) {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		result = append(result, t)
+	}
+	return result
+}
+
+// Create a new Pool instance.
+func New(tokens []string, strategy Strategy, cooldown time.Duration) *Pool {
+	switch strategy {
+	case RoundRobin, LeastRecentlyUsed, LeastInFlight:
+	default:
+		if strategy != "" {
+			log.ZLog.Log.Warn().Msgf("Unknown pool strategy %q, use %s instead", strategy, defaultStrategy)
+		}
+		strategy = defaultStrategy
+	}
+	p := &Pool{strategy: strategy, cooldown: cooldown}
+	for i, token := range tokens {
+		p.accounts = append(p.accounts, &Account{ID: i + 1, Token: token})
+	}
+	return p
+}
+
+// Len returns the number of accounts in the pool.
+func (p *Pool) Len() int {
+	return len(p.accounts)
+}
+
+// Acquire an account for a request. The account must be given back with Release.
+// When every account is cooling down, the one that recovers first is used anyway.
+func (p *Pool) Acquire() (*Account, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.accounts) == 0 {
+		return nil, ErrNoAccount
+	}
+
+	now := time.Now()
+	account := p.pick(now, nil)
+	if account == nil {
+		account = p.accounts[0]
+		for _, a := range p.accounts[1:] {
+			if a.cooldownUntil.Before(account.cooldownUntil) {
+				account = a
+			}
+		}
+		log.ZLog.Log.Warn().Msgf("All github copilot accounts are cooling down, use account #%d", account.ID)
+	}
+
+	account.inFlight++
+	account.lastUsed = now
+	return account, nil
+}
+
+// Acquire an account other than the excluded one, e.g. to retry a request that failed
+// with it. Unlike Acquire, no account is used while it is cooling down.
+func (p *Pool) AcquireExcept(excluded *Account) (*Account, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	account := p.pick(now, excluded)
+	if account == nil {
+		return nil, ErrNoAccount
+	}
+	account.inFlight++
+	account.lastUsed = now
+	return account, nil
+}
+
+// Pick an account that is not cooling down according to the strategy, nil if there is none.
+// The excluded account is never picked.
+func (p *Pool) pick(now time.Time, excluded *Account) *Account {
+	var account *Account
+	for i := range p.accounts {
+		// round robin starts after the account picked last time
+		index := i
+		if p.strategy == RoundRobin {
+			index = (p.next + i) % len(p.accounts)
+		}
+		a := p.accounts[index]
+		if a == excluded || a.cooldownUntil.After(now) {
+			continue
+		}
+		if account == nil {
+			account = a
+			if p.strategy == RoundRobin {
+				p.next = index + 1
+				break
+			}
+			continue
+		}
+		switch p.strategy {
+		case LeastRecentlyUsed:
+			if a.lastUsed.Before(account.lastUsed) {
+				account = a
+			}
+		case LeastInFlight:
+			if a.inFlight < account.inFlight || (a.inFlight == account.inFlight && a.lastUsed.Before(account.lastUsed)) {
+				account = a
+			}
+		}
+	}
+	return account
+}
+
+// Release the account after the request finished. statusCode is the upstream status
+// of the request, 0 if upstream was not reached. Accounts answered with 401, 403 or
+// 429 are taken out of rotation for the cooldown period.
+func (p *Pool) Release(account *Account, statusCode int) {
+	if account == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if account.inFlight > 0 {
+		account.inFlight--
+	}
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		account.cooldownUntil = time.Now().Add(p.cooldown)
+		log.ZLog.Log.Warn().Msgf("Github copilot account #%d got status %d, cooling down until %s",
+			account.ID, statusCode, account.cooldownUntil.Format("2006-01-02 15:04:05"))
+	}
+}
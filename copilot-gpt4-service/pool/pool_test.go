@@ -0,0 +1,202 @@
+package pool
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"copilot-gpt4-service/log"
+)
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+func acquire(t *testing.T, p *Pool) *Account {
+	t.Helper()
+	account, err := p.Acquire()
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	return account
+}
+
+func ids(accounts ...*Account) []int {
+	result := make([]int, 0, len(accounts))
+	for _, a := range accounts {
+		result = append(result, a.ID)
+	}
+	return result
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTokens(t *testing.T) {
+	tokens := Tokens("a", " b,a,, c ,b")
+	if len(tokens) != 3 || tokens[0] != "a" || tokens[1] != "b" || tokens[2] != "c" {
+		t.Fatalf("unexpected tokens: %q", tokens)
+	}
+	if tokens := Tokens("", ""); len(tokens) != 0 {
+		t.Fatalf("unexpected tokens: %q", tokens)
+	}
+}
+
+func TestEmptyPool(t *testing.T) {
+	p := New(nil, RoundRobin, time.Minute)
+	if _, err := p.Acquire(); err != ErrNoAccount {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := p.AcquireExcept(nil); err != ErrNoAccount {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	if p := New([]string{"a"}, "random", time.Minute); p.strategy != RoundRobin {
+		t.Fatalf("unexpected strategy: %s", p.strategy)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	p := New([]string{"a", "b", "c"}, RoundRobin, time.Minute)
+	var got []*Account
+	for i := 0; i < 4; i++ {
+		account := acquire(t, p)
+		got = append(got, account)
+		p.Release(account, http.StatusOK)
+	}
+	if !equal(ids(got...), []int{1, 2, 3, 1}) {
+		t.Fatalf("unexpected order: %v", ids(got...))
+	}
+}
+
+func TestLeastRecentlyUsed(t *testing.T) {
+	p := New([]string{"a", "b", "c"}, LeastRecentlyUsed, time.Minute)
+	first := acquire(t, p)
+	time.Sleep(time.Millisecond)
+	second := acquire(t, p)
+	time.Sleep(time.Millisecond)
+	third := acquire(t, p)
+	time.Sleep(time.Millisecond)
+	p.Release(first, http.StatusOK)
+	p.Release(second, http.StatusOK)
+	p.Release(third, http.StatusOK)
+
+	// a is used again first, which leaves b as the least recently used one
+	again := acquire(t, p)
+	p.Release(again, http.StatusOK)
+	if next := acquire(t, p); !equal(ids(first, second, third, again, next), []int{1, 2, 3, 1, 2}) {
+		t.Fatalf("unexpected order: %v", ids(first, second, third, again, next))
+	}
+}
+
+func TestLeastInFlight(t *testing.T) {
+	p := New([]string{"a", "b"}, LeastInFlight, time.Minute)
+	first := acquire(t, p)
+	second := acquire(t, p)
+	third := acquire(t, p)
+	if !equal(ids(first, second), []int{1, 2}) || third.ID != 1 {
+		t.Fatalf("unexpected accounts: %v", ids(first, second, third))
+	}
+	// a serves two requests, b none after its release
+	p.Release(second, http.StatusOK)
+	if next := acquire(t, p); next.ID != 2 {
+		t.Fatalf("expected account #2, got #%d", next.ID)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests} {
+		p := New([]string{"a", "b"}, RoundRobin, time.Minute)
+		failed := acquire(t, p)
+		p.Release(failed, status)
+		for i := 0; i < 3; i++ {
+			account := acquire(t, p)
+			if account == failed {
+				t.Fatalf("status %d: account #%d used while cooling down", status, account.ID)
+			}
+			p.Release(account, http.StatusOK)
+		}
+	}
+}
+
+func TestCooldownOtherStatus(t *testing.T) {
+	p := New([]string{"a"}, RoundRobin, time.Minute)
+	p.Release(acquire(t, p), http.StatusInternalServerError)
+	if account := acquire(t, p); !account.cooldownUntil.IsZero() {
+		t.Fatalf("account cooling down after a server error: %v", account.cooldownUntil)
+	}
+}
+
+func TestCooldownExpires(t *testing.T) {
+	p := New([]string{"a", "b"}, RoundRobin, 10*time.Millisecond)
+	failed := acquire(t, p)
+	p.Release(failed, http.StatusTooManyRequests)
+	time.Sleep(20 * time.Millisecond)
+	p.Release(acquire(t, p), http.StatusOK)
+	if account := acquire(t, p); account != failed {
+		t.Fatalf("expected account #%d after the cooldown, got #%d", failed.ID, account.ID)
+	}
+}
+
+func TestAllCoolingDown(t *testing.T) {
+	p := New([]string{"a", "b"}, RoundRobin, time.Minute)
+	a := acquire(t, p)
+	b := acquire(t, p)
+	p.Release(b, http.StatusTooManyRequests)
+	time.Sleep(time.Millisecond)
+	p.Release(a, http.StatusTooManyRequests)
+
+	// the account that recovers first is used anyway
+	if account := acquire(t, p); account != b {
+		t.Fatalf("expected account #%d, got #%d", b.ID, account.ID)
+	}
+	if _, err := p.AcquireExcept(nil); err != ErrNoAccount {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAcquireExcept(t *testing.T) {
+	p := New([]string{"a", "b"}, RoundRobin, time.Minute)
+	first := acquire(t, p)
+	for i := 0; i < 3; i++ {
+		account, err := p.AcquireExcept(first)
+		if err != nil || account == first {
+			t.Fatalf("unexpected account: %v, %v", account, err)
+		}
+		p.Release(account, http.StatusOK)
+	}
+	single := New([]string{"a"}, RoundRobin, time.Minute)
+	if _, err := single.AcquireExcept(acquire(t, single)); err != ErrNoAccount {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	p := New([]string{"a"}, RoundRobin, time.Minute)
+	account := acquire(t, p)
+	acquire(t, p)
+	if account.inFlight != 2 {
+		t.Fatalf("unexpected in flight: %d", account.inFlight)
+	}
+	p.Release(account, http.StatusOK)
+	p.Release(account, http.StatusOK)
+	p.Release(account, http.StatusOK)
+	if account.inFlight != 0 {
+		t.Fatalf("unexpected in flight: %d", account.inFlight)
+	}
+	p.Release(nil, http.StatusOK)
+}
@@ -0,0 +1,249 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limits of a single caller, 0 means no limit.
+type Limits struct {
+	RequestsPerMinute int
+	TokensPerMinute   int
+	MaxConcurrent     int
+}
+
+// Reason of a rejected request.
+type Reason string
+
+const (
+	ReasonNone        Reason = ""
+	ReasonRequests    Reason = "requests"
+	ReasonTokens      Reason = "tokens"
+	ReasonConcurrency Reason = "concurrency"
+)
+
+// Status is the state of the limits of a caller, as reported in the x-ratelimit-* headers.
+type Status struct {
+	Limits            Limits
+	RemainingRequests int
+	RemainingTokens   int
+	ResetRequests     time.Duration
+	ResetTokens       time.Duration
+	// Why the request was rejected and when to retry, empty if it was allowed.
+	Rejected   Reason
+	RetryAfter time.Duration
+}
+
+// tokenBucket allows to go into debt, since the tokens of a request are only
+// known after it is done. A caller in debt is rejected until the debt is refilled.
+type tokenBucket struct {
+	capacity  float64
+	available float64
+	perSecond float64
+	updated   time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity:  float64(perMinute),
+		available: float64(perMinute),
+		perSecond: float64(perMinute) / 60,
+		updated:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.available = math.Min(b.capacity, b.available+now.Sub(b.updated).Seconds()*b.perSecond)
+	b.updated = now
+}
+
+// Time until the bucket holds the amount of tokens again.
+func (b *tokenBucket) until(amount float64) time.Duration {
+	if b.available >= amount {
+		return 0
+	}
+	return time.Duration((amount - b.available) / b.perSecond * float64(time.Second))
+}
+
+// requestWindow keeps the times of the requests within the last minute, so that no more
+// than the limit are allowed within any minute, including the first one of a caller.
+type requestWindow struct {
+	limit int
+	times []time.Time
+}
+
+func newRequestWindow(perMinute int) *requestWindow {
+	return &requestWindow{limit: perMinute, times: make([]time.Time, 0, perMinute)}
+}
+
+// Forget the requests that left the window.
+func (w *requestWindow) expire(now time.Time) {
+	i := 0
+	for i < len(w.times) && now.Sub(w.times[i]) >= time.Minute {
+		i++
+	}
+	w.times = w.times[i:]
+}
+
+// Record a request if the limit allows it.
+func (w *requestWindow) allow(now time.Time) bool {
+	w.expire(now)
+	if len(w.times) >= w.limit {
+		return false
+	}
+	w.times = append(w.times, now)
+	return true
+}
+
+// Time until the oldest request leaves the window and the next one is allowed.
+func (w *requestWindow) next(now time.Time) time.Duration {
+	if len(w.times) < w.limit {
+		return 0
+	}
+	return w.times[0].Add(time.Minute).Sub(now)
+}
+
+// Time until every request left the window.
+func (w *requestWindow) reset(now time.Time) time.Duration {
+	if len(w.times) == 0 {
+		return 0
+	}
+	return w.times[len(w.times)-1].Add(time.Minute).Sub(now)
+}
+
+type entry struct {
+	requests *requestWindow
+	tokens   *tokenBucket
+	inFlight int
+	lastSeen time.Time
+}
+
+// Limiter keeps the limits of every caller, keyed by the caller identity.
+// Callers that have been idle for a while are evicted.
+type Limiter struct {
+	mu          sync.Mutex
+	limits      Limits
+	idleTimeout time.Duration
+	entries     map[string]*entry
+	lastSweep   time.Time
+}
+
+// Create a new Limiter instance.
+func New(limits Limits, idleTimeout time.Duration) *Limiter {
+	return &Limiter{
+		limits:      limits,
+		idleTimeout: idleTimeout,
+		entries:     make(map[string]*entry),
+		lastSweep:   time.Now(),
+	}
+}
+
+// Enabled reports whether any limit is set.
+func (l *Limiter) Enabled() bool {
+	return l.limits.RequestsPerMinute > 0 || l.limits.TokensPerMinute > 0 || l.limits.MaxConcurrent > 0
+}
+
+// Len returns the number of callers currently tracked.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Get the entry of the caller, creating it if needed. Must be called with the lock held.
+func (l *Limiter) entry(identity string, now time.Time) *entry {
+	if now.Sub(l.lastSweep) > l.idleTimeout/2 {
+		l.sweep(now)
+	}
+	e, ok := l.entries[identity]
+	if !ok {
+		e = &entry{}
+		if l.limits.RequestsPerMinute > 0 {
+			e.requests = newRequestWindow(l.limits.RequestsPerMinute)
+		}
+		if l.limits.TokensPerMinute > 0 {
+			e.tokens = newTokenBucket(l.limits.TokensPerMinute, now)
+		}
+		l.entries[identity] = e
+	}
+	e.lastSeen = now
+	return e
+}
+
+// Evict the callers without requests in flight that have been idle for longer than the timeout.
+func (l *Limiter) sweep(now time.Time) {
+	for identity, e := range l.entries {
+		if e.inFlight == 0 && now.Sub(e.lastSeen) > l.idleTimeout {
+			delete(l.entries, identity)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Fill the status from the entry. Must be called with the lock held.
+func (l *Limiter) status(e *entry, now time.Time) Status {
+	status := Status{Limits: l.limits}
+	if e.requests != nil {
+		e.requests.expire(now)
+		status.RemainingRequests = e.requests.limit - len(e.requests.times)
+		status.ResetRequests = e.requests.reset(now)
+	}
+	if e.tokens != nil {
+		e.tokens.refill(now)
+		status.RemainingTokens = int(math.Max(0, math.Floor(e.tokens.available)))
+		status.ResetTokens = e.tokens.until(e.tokens.capacity)
+	}
+	return status
+}
+
+// Acquire a slot for a request of the caller. If the request is allowed, the
+// returned release function must be called with the tokens used by the request
+// once it is done. If it is rejected, the release function is nil.
+func (l *Limiter) Acquire(identity string) (Status, func(tokens int)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	e := l.entry(identity, now)
+	if e.tokens != nil {
+		e.tokens.refill(now)
+	}
+
+	var rejected Reason
+	var retryAfter time.Duration
+	switch {
+	case l.limits.MaxConcurrent > 0 && e.inFlight >= l.limits.MaxConcurrent:
+		rejected = ReasonConcurrency
+		retryAfter = time.Second
+	case e.tokens != nil && e.tokens.available <= 0:
+		rejected = ReasonTokens
+		retryAfter = e.tokens.until(1)
+	case e.requests != nil && !e.requests.allow(now):
+		rejected = ReasonRequests
+		retryAfter = e.requests.next(now)
+	}
+	status := l.status(e, now)
+	if rejected != ReasonNone {
+		status.Rejected = rejected
+		status.RetryAfter = retryAfter
+		return status, nil
+	}
+
+	e.inFlight++
+	released := false
+	return status, func(tokens int) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if released {
+			return
+		}
+		released = true
+		e.inFlight--
+		e.lastSeen = time.Now()
+		if e.tokens != nil && tokens > 0 {
+			e.tokens.refill(e.lastSeen)
+			e.tokens.available -= float64(tokens)
+		}
+	}
+}
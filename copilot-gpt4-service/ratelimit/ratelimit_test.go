@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDisabled(t *testing.T) {
+	l := New(Limits{}, time.Minute)
+	if l.Enabled() {
+		t.Fatal("limiter without limits should be disabled")
+	}
+	for i := 0; i < 100; i++ {
+		if _, release := l.Acquire("caller"); release == nil {
+			t.Fatalf("request %d rejected without limits", i)
+		}
+	}
+}
+
+func TestRequestsPerMinute(t *testing.T) {
+	l := New(Limits{RequestsPerMinute: 3}, time.Minute)
+	for i := 0; i < 3; i++ {
+		status, release := l.Acquire("caller")
+		if release == nil {
+			t.Fatalf("request %d rejected: %+v", i, status)
+		}
+		release(0)
+		if status.RemainingRequests != 2-i {
+			t.Fatalf("request %d: unexpected remaining requests %d", i, status.RemainingRequests)
+		}
+	}
+	status, release := l.Acquire("caller")
+	if release != nil || status.Rejected != ReasonRequests {
+		t.Fatalf("request over the limit allowed: %+v", status)
+	}
+	if status.RetryAfter <= 0 || status.RetryAfter > time.Minute || status.ResetRequests > time.Minute {
+		t.Fatalf("unexpected retry after %s, reset %s", status.RetryAfter, status.ResetRequests)
+	}
+	// every caller has its own limit
+	if _, release := l.Acquire("other"); release == nil {
+		t.Fatal("request of another caller rejected")
+	}
+}
+
+func TestRequestWindow(t *testing.T) {
+	now := time.Now()
+	w := newRequestWindow(2)
+	if !w.allow(now) || !w.allow(now.Add(10*time.Second)) {
+		t.Fatal("requests within the limit rejected")
+	}
+	// no burst beyond the limit within any minute, also not in the first one
+	if w.allow(now.Add(59 * time.Second)) {
+		t.Fatal("third request within a minute allowed")
+	}
+	if next := w.next(now.Add(30 * time.Second)); next != 30*time.Second {
+		t.Fatalf("unexpected next: %s", next)
+	}
+	if reset := w.reset(now.Add(30 * time.Second)); reset != 40*time.Second {
+		t.Fatalf("unexpected reset: %s", reset)
+	}
+	if !w.allow(now.Add(time.Minute)) {
+		t.Fatal("request rejected after the first one left the window")
+	}
+	if w.allow(now.Add(69 * time.Second)) {
+		t.Fatal("request allowed before the second one left the window")
+	}
+	if !w.allow(now.Add(70 * time.Second)) {
+		t.Fatal("request rejected after the second one left the window")
+	}
+}
+
+func TestTokensPerMinute(t *testing.T) {
+	l := New(Limits{TokensPerMinute: 100}, time.Minute)
+	status, release := l.Acquire("caller")
+	if release == nil || status.RemainingTokens != 100 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	// the tokens are only known once the request is done, the caller goes into debt
+	release(150)
+	status, release = l.Acquire("caller")
+	if release != nil || status.Rejected != ReasonTokens {
+		t.Fatalf("request of a caller in debt allowed: %+v", status)
+	}
+	if status.RetryAfter < 29*time.Second || status.RetryAfter > 31*time.Second {
+		t.Fatalf("unexpected retry after: %s", status.RetryAfter)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(60, now)
+	b.available = -30
+	if until := b.until(1); until != 31*time.Second {
+		t.Fatalf("unexpected until: %s", until)
+	}
+	b.refill(now.Add(31 * time.Second))
+	if b.available != 1 {
+		t.Fatalf("unexpected available tokens: %v", b.available)
+	}
+	b.refill(now.Add(time.Hour))
+	if b.available != 60 {
+		t.Fatalf("refilled beyond the capacity: %v", b.available)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	l := New(Limits{MaxConcurrent: 2}, time.Minute)
+	_, first := l.Acquire("caller")
+	_, second := l.Acquire("caller")
+	if first == nil || second == nil {
+		t.Fatal("requests within the limit rejected")
+	}
+	status, third := l.Acquire("caller")
+	if third != nil || status.Rejected != ReasonConcurrency || status.RetryAfter <= 0 {
+		t.Fatalf("request over the limit allowed: %+v", status)
+	}
+	first(0)
+	// releasing twice does not free another slot
+	first(0)
+	if _, release := l.Acquire("caller"); release == nil {
+		t.Fatal("request rejected after a release")
+	}
+	if status, release := l.Acquire("caller"); release != nil {
+		t.Fatalf("request over the limit allowed: %+v", status)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := New(Limits{MaxConcurrent: 1}, 10*time.Millisecond)
+	_, release := l.Acquire("idle")
+	release(0)
+	_, busy := l.Acquire("busy")
+	if l.Len() != 2 {
+		t.Fatalf("unexpected callers: %d", l.Len())
+	}
+	time.Sleep(20 * time.Millisecond)
+	l.Acquire("new")
+	// the idle caller is evicted, the one with a request in flight is kept
+	if l.Len() != 2 {
+		t.Fatalf("unexpected callers after the sweep: %d", l.Len())
+	}
+	if status, release := l.Acquire("busy"); release != nil {
+		t.Fatalf("limit of the busy caller lost: %+v", status)
+	}
+	busy(0)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"copilot-gpt4-service/config"
+	"copilot-gpt4-service/log"
+	"copilot-gpt4-service/metrics"
+	"copilot-gpt4-service/transport"
+	"copilot-gpt4-service/utils"
+)
+
+// Longest wait before a retry, whatever the backoff or the Retry-After of upstream.
+const maxRetryBackoff = 10 * time.Second
+
+// A request to the GitHub Copilot API, sent again on every attempt.
+type upstreamRequest struct {
+	// Upstream endpoint, for the metrics
+	endpoint string
+	url      string
+	body     []byte
+	stream   bool
+}
+
+// Whether a response with the status is worth another attempt with the same account.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Return the wait before the retry, exponential in the number of retries so far with
+// jitter, so that the requests failing together do not retry together. A Retry-After
+// of upstream is waited for. Returns false, with the backoff, if it is longer than
+// maxRetryBackoff: the request is not retried then, the response is passed on with its
+// Retry-After.
+func retryBackoff(retry int, resp *http.Response) (time.Duration, bool) {
+	backoff := time.Duration(config.ConfigInstance.UpstreamRetryBackoff) * time.Millisecond << (retry - 1)
+	if backoff > maxRetryBackoff || backoff < 0 {
+		backoff = maxRetryBackoff
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter := time.Duration(seconds) * time.Second
+			if retryAfter > maxRetryBackoff {
+				return backoff, false
+			}
+			if retryAfter > backoff {
+				backoff = retryAfter
+			}
+		}
+	}
+	return backoff, true
+}
+
+// Send the request to the GitHub Copilot API with the Copilot token of appToken, the token
+// or pooled account of the caller. Failed attempts are retried, nothing has reached the
+// client yet: network errors and retryable statuses after a backoff, unless upstream asks
+// to retry later than maxRetryBackoff, a 401 after the Copilot token is exchanged again,
+// and with UPSTREAM_FAILOVER, the network errors and failures of a pooled account with
+// another account of the pool. Returns the successful response, or else the
+// response or the error of the last attempt. Only the failure of the last attempt counts as
+// upstream error in the metrics, the retries are counted on their own.
+func sendUpstream(c *gin.Context, ctx context.Context, appToken string, r upstreamRequest) (*http.Response, error) {
+	cfg := config.ConfigInstance
+	span := trace.SpanFromContext(ctx)
+	renewed := false
+	for attempt := 1; ; attempt++ {
+		headers := createHeaders(ctx, appToken, r.stream)
+		req, _ := http.NewRequestWithContext(ctx, "POST", r.url, bytes.NewReader(r.body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := transport.ClientInstance.Do(req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			if attempt > 1 {
+				log.ZLog.Log.Info().Msgf("Github copilot request succeeded on attempt %d", attempt)
+			}
+			span.SetAttributes(attribute.Int("copilot.attempts", attempt))
+			return resp, nil
+		}
+
+		status := 0
+		outcome := ""
+		if err != nil {
+			outcome = err.Error()
+		} else {
+			status = resp.StatusCode
+			outcome = resp.Status
+		}
+		span.AddEvent("upstream attempt failed", trace.WithAttributes(
+			attribute.Int("copilot.attempt", attempt), attribute.Int("http.response.status_code", status)))
+		span.SetAttributes(attribute.Int("copilot.attempts", attempt))
+		if attempt > cfg.UpstreamRetries || ctx.Err() != nil || errors.Is(err, context.Canceled) {
+			log.ZLog.Log.Warn().Msgf("Github copilot request attempt %d failed: %s, giving up", attempt, outcome)
+			metrics.UpstreamError(r.endpoint, status)
+			return resp, err
+		}
+
+		// Decide how to retry, the response is kept as long as it may be the last one
+		reason, wait := "", time.Duration(0)
+		switch {
+		case err != nil:
+			reason = metrics.RetryNetwork
+			wait, _ = retryBackoff(attempt, nil)
+			if cfg.UpstreamFailover {
+				if token, ok := utils.SwitchAuthorization(c, status); ok {
+					appToken, renewed = token, false
+					reason = metrics.RetryFailover
+				}
+			}
+		case status == http.StatusUnauthorized && !renewed:
+			staleToken := strings.TrimPrefix(headers["Authorization"], "Bearer ")
+			if _, _, errorInfo := utils.RenewAuthorization(ctx, appToken, staleToken); errorInfo == "" {
+				renewed = true
+				reason = metrics.RetryRenew
+				break
+			}
+			fallthrough
+		case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests || retryableStatus(status):
+			if cfg.UpstreamFailover {
+				if token, ok := utils.SwitchAuthorization(c, status); ok {
+					appToken, renewed = token, false
+					reason = metrics.RetryFailover
+					if retryableStatus(status) {
+						// a Retry-After too long to wait for is left to the previous account
+						wait, _ = retryBackoff(attempt, resp)
+					}
+					break
+				}
+			}
+			if retryableStatus(status) {
+				var ok bool
+				if wait, ok = retryBackoff(attempt, resp); ok {
+					reason = metrics.RetryStatus
+				} else {
+					outcome += ", Retry-After " + resp.Header.Get("Retry-After")
+				}
+			}
+		}
+		if reason == "" {
+			log.ZLog.Log.Warn().Msgf("Github copilot request attempt %d failed: %s, not retryable", attempt, outcome)
+			metrics.UpstreamError(r.endpoint, status)
+			return resp, err
+		}
+
+		log.ZLog.Log.Warn().Msgf("Github copilot request attempt %d failed: %s, retrying (%s) in %s", attempt, outcome, reason, wait)
+		metrics.UpstreamRetry(r.endpoint, reason)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			metrics.UpstreamError(r.endpoint, status)
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"copilot-gpt4-service/config"
+	"copilot-gpt4-service/metrics"
+	"copilot-gpt4-service/ratelimit"
+)
+
+// Create the router of the service with every route and middleware enabled by the configuration.
+func NewRouter() *gin.Engine {
+	router := gin.Default()
+	router.Use(TracingHandler())
+	router.Use(CORSMiddleware())
+	router.Use(LoggerHandler())
+	if config.ConfigInstance.Metrics {
+		router.Use(MetricsHandler())
+		router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	}
+
+	router.StaticFile("/robots.txt", "./robots.txt")
+
+	limiter := ratelimit.New(ratelimit.Limits{
+		RequestsPerMinute: config.ConfigInstance.RateLimit,
+		TokensPerMinute:   config.ConfigInstance.RateLimitTokens,
+		MaxConcurrent:     config.ConfigInstance.RateLimitConcurrency,
+	}, 10*time.Minute)
+	router.POST("/v1/chat/completions", RateLimiterHandler(limiter), UsageRecorderHandler(), chatCompletions)
+	router.POST("/v1/embeddings", RateLimiterHandler(limiter), UsageRecorderHandler(), embeddings)
+	router.GET("/v1/models", RateLimiterHandler(limiter), listModels)
+	router.GET("/v1/models/:id", RateLimiterHandler(limiter), getModel)
+	router.GET("/healthz", func(context *gin.Context) {
+		context.JSON(200, gin.H{
+			"message": "ok",
+		})
+	})
+	router.GET("/", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(`
+		<div style="color:red;padding:0 20px;display:grid;align-items:center;justify-content:center;height:98vh;overflow:hidden;font-size:20px;line-height:30px;text-align:center;"><b>Very important: please do not make this service public, for personal use only, otherwise the account or Copilot will be banned.<br>非常重要：请不要将此服务公开，仅供个人使用，否则账户或 Copilot 将被封禁。</b></div>`))
+	})
+	router.NoRoute(func(c *gin.Context) {
+		respondWithError(c, http.StatusNotFound, fmt.Sprintf("Invalid URL (%s %s)", c.Request.Method, c.Request.URL.Path))
+	})
+
+	if config.ConfigInstance.AdminToken != "" {
+		admin := router.Group("/admin", AdminAuthHandler())
+		admin.GET("/keys", listKeys)
+		admin.POST("/keys", createKey)
+		admin.GET("/keys/:id", getKey)
+		admin.POST("/keys/:id/rotate", rotateKey)
+		admin.DELETE("/keys/:id", revokeKey)
+		admin.GET("/usage", usageReport)
+	}
+
+	if config.ConfigInstance.CORSProxyNextChat {
+		router.Any("/cors-proxy-nextchat/*path", corsProxyNextChat)
+	}
+
+	return router
+}
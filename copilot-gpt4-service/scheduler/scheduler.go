@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"copilot-gpt4-service/log"
+)
+
+// Job is a task that runs periodically in the background.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context)
+}
+
+// Start every job with a positive interval on its own ticker, until the context is done.
+// The returned function waits until every job has stopped.
+func Start(ctx context.Context, jobs ...Job) func() {
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		if job.Interval <= 0 {
+			log.ZLog.Log.Info().Msgf("Background job %s is disabled", job.Name)
+			continue
+		}
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			ticker := time.NewTicker(job.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					job.Run(ctx)
+				}
+			}
+		}(job)
+	}
+	return wg.Wait
+}
@@ -0,0 +1,71 @@
+package scheduler
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"copilot-gpt4-service/log"
+)
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs, disabled atomic.Int32
+	wait := Start(ctx,
+		Job{Name: "counter", Interval: 10 * time.Millisecond, Run: func(context.Context) { runs.Add(1) }},
+		Job{Name: "disabled", Interval: 0, Run: func(context.Context) { disabled.Add(1) }},
+	)
+
+	deadline := time.Now().Add(time.Second)
+	for runs.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the job ran %d times within a second", runs.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the jobs did not stop when the context was done")
+	}
+	after := runs.Load()
+	time.Sleep(30 * time.Millisecond)
+	if runs.Load() != after {
+		t.Fatal("the job ran after it stopped")
+	}
+	if disabled.Load() != 0 {
+		t.Fatal("a job without interval ran")
+	}
+}
+
+func TestStartPassesContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan context.Context, 1)
+	wait := Start(ctx, Job{Name: "context", Interval: time.Millisecond, Run: func(ctx context.Context) {
+		select {
+		case ran <- ctx:
+		default:
+		}
+	}})
+	jobCtx := <-ran
+	cancel()
+	wait()
+	if jobCtx.Err() == nil {
+		t.Fatal("the job context is not done after the scheduler stopped")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"copilot-gpt4-service/log"
+)
+
+// How long the aborted streams get to write their final chunk before the connections are closed.
+const abortGracePeriod = 5 * time.Second
+
+// streamTracker keeps count of the streams in flight, so that they can be drained on shutdown.
+type streamTracker struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	cutoff chan struct{}
+	// set once Wait is called, streams are not tracked anymore so that wg.Add does not race with wg.Wait
+	closed bool
+}
+
+var streams = newStreamTracker()
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{cutoff: make(chan struct{})}
+}
+
+// Track a stream until done is called. The returned channel is closed when the
+// stream must end early, because the service is shutting down. A stream started
+// while the streams are drained is cut off right away.
+func (t *streamTracker) Track() (<-chan struct{}, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		cutoff := make(chan struct{})
+		close(cutoff)
+		return cutoff, func() {}
+	}
+	t.wg.Add(1)
+	return t.cutoff, t.wg.Done
+}
+
+// Cut off the streams in flight. Streams started afterwards are not affected.
+func (t *streamTracker) Cutoff() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	close(t.cutoff)
+	t.cutoff = make(chan struct{})
+}
+
+// Wait until the streams in flight are done, false if they are not done within the timeout.
+// Streams started afterwards are not waited for, they are cut off right away.
+func (t *streamTracker) Wait(timeout time.Duration) bool {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Serve the requests on the listener until the context is done, then shut down gracefully:
+// stop accepting new requests, let the requests in flight finish within the timeout, and cut
+// off the streams that are still running with an error chunk.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.ZLog.Log.Info().Msgf("Shutting down, waiting up to %s for the requests in flight", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.ZLog.Log.Warn().Msg("Shutdown timeout exceeded, cutting off the streams in flight")
+		streams.Cutoff()
+		if !streams.Wait(abortGracePeriod) {
+			log.ZLog.Log.Warn().Msg("Streams did not end in time, closing the connections")
+		}
+		err = server.Close()
+	}
+	if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.ZLog.Log.Error().Err(err).Msg("Server stopped with an error")
+	}
+
+	log.ZLog.Log.Info().Msg("Server stopped")
+	return err
+}
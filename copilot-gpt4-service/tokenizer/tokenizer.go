@@ -0,0 +1,181 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+
+	"copilot-gpt4-service/log"
+)
+
+// Names of the supported BPE encodings.
+const (
+	CL100kBase = "cl100k_base"
+	O200kBase  = "o200k_base"
+)
+
+const (
+	tokensPerMessage  = 3 // every message is wrapped as <|start|>{role}\n{content}<|end|>\n
+	tokensPerName     = 1 // if there is a name, the role is omitted
+	tokensReplyPrimer = 3 // every reply is primed with <|start|>assistant<|message|>
+	tokensPerImage    = 85
+)
+
+// Model prefixes that use the o200k_base encoding, every other model uses cl100k_base.
+var o200kPrefixes = []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"}
+
+var (
+	encodings   = make(map[string]*tiktoken.Tiktoken)
+	encodingsMu sync.Mutex
+)
+
+func init() {
+	// The merge tables are embedded in the binary, so no download is needed at runtime.
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// Return the name of the encoding used by the model.
+func EncodingForModel(model string) string {
+	model = strings.ToLower(model)
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return O200kBase
+		}
+	}
+	return CL100kBase
+}
+
+// Load the encoding once and keep it for the lifetime of the process.
+func getEncoding(name string) *tiktoken.Tiktoken {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	if enc, ok := encodings[name]; ok {
+		return enc
+	}
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msgf("Load tokenizer encoding %s failed", name)
+		return nil
+	}
+	encodings[name] = enc
+	return enc
+}
+
+// Count the tokens of the text as the model would see them.
+func Count(model string, text string) int {
+	if text == "" {
+		return 0
+	}
+	enc := getEncoding(EncodingForModel(model))
+	if enc == nil {
+		// rough estimation when the encoding can not be loaded
+		return (len(text) + 3) / 4
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+type functionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type message struct {
+	Role         string          `json:"role"`
+	Name         string          `json:"name"`
+	Content      json.RawMessage `json:"content"`
+	ToolCallID   string          `json:"tool_call_id"`
+	FunctionCall *functionCall   `json:"function_call"`
+	ToolCalls    []struct {
+		Function functionCall `json:"function"`
+	} `json:"tool_calls"`
+}
+
+// Count the tokens of a message content, which is either a string or an array of parts.
+func countContent(model string, content json.RawMessage) int {
+	if len(content) == 0 {
+		return 0
+	}
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return Count(model, text)
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return 0
+	}
+	tokens := 0
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			tokens += Count(model, part.Text)
+		case "image_url":
+			tokens += tokensPerImage
+		}
+	}
+	return tokens
+}
+
+// Count the prompt tokens of the raw chat messages, following the accounting of the OpenAI cookbook.
+func CountMessages(model string, messages json.RawMessage) int {
+	var items []message
+	if err := json.Unmarshal(messages, &items); err != nil {
+		return 0
+	}
+
+	tokens := 0
+	for _, item := range items {
+		tokens += tokensPerMessage
+		tokens += Count(model, item.Role)
+		tokens += countContent(model, item.Content)
+		if item.Name != "" {
+			tokens += tokensPerName + Count(model, item.Name)
+		}
+		if item.ToolCallID != "" {
+			tokens += Count(model, item.ToolCallID)
+		}
+		if item.FunctionCall != nil {
+			tokens += Count(model, item.FunctionCall.Name) + Count(model, item.FunctionCall.Arguments)
+		}
+		for _, call := range item.ToolCalls {
+			tokens += Count(model, call.Function.Name) + Count(model, call.Function.Arguments)
+		}
+	}
+	tokens += tokensReplyPrimer
+	return tokens
+}
+
+// Count the prompt tokens of the raw tool or function definitions. The exact rendering
+// of the definitions is not public, their JSON is a close estimate.
+func CountTools(model string, tools json.RawMessage) int {
+	if len(tools) == 0 || string(tools) == "null" {
+		return 0
+	}
+	return Count(model, string(tools))
+}
+
+// Count the tokens of an embeddings input, which is a string, an array of strings,
+// an array of token ids or an array of arrays of token ids.
+func CountInput(model string, input interface{}) int {
+	switch v := input.(type) {
+	case string:
+		return Count(model, v)
+	case []interface{}:
+		tokens := 0
+		for _, item := range v {
+			switch item.(type) {
+			case float64, json.Number:
+				tokens++
+			default:
+				tokens += CountInput(model, item)
+			}
+		}
+		return tokens
+	}
+	return 0
+}
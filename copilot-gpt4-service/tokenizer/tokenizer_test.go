@@ -0,0 +1,110 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEncodingForModel(t *testing.T) {
+	tests := map[string]string{
+		"gpt-4":             CL100kBase,
+		"gpt-3.5-turbo":     CL100kBase,
+		"GPT-4o":            O200kBase,
+		"gpt-4o-mini":       O200kBase,
+		"o1-preview":        O200kBase,
+		"claude-3.5-sonnet": CL100kBase,
+		"":                  CL100kBase,
+	}
+	for model, want := range tests {
+		if got := EncodingForModel(model); got != want {
+			t.Errorf("EncodingForModel(%q) = %s, want %s", model, got, want)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	tests := []struct {
+		model string
+		text  string
+		want  int
+	}{
+		{"gpt-4", "", 0},
+		{"gpt-4", "hello world", 2},
+		{"gpt-4", "tiktoken is great!", 6},
+		{"gpt-4o", "hello world", 2},
+	}
+	for _, test := range tests {
+		if got := Count(test.model, test.text); got != test.want {
+			t.Errorf("Count(%q, %q) = %d, want %d", test.model, test.text, got, test.want)
+		}
+	}
+}
+
+func TestCountMessages(t *testing.T) {
+	hello := Count("gpt-4", "hello world")
+	user := Count("gpt-4", "user")
+	tests := []struct {
+		name     string
+		messages string
+		want     int
+	}{
+		{
+			name:     "string content",
+			messages: `[{"role":"user","content":"hello world"}]`,
+			want:     tokensPerMessage + user + hello + tokensReplyPrimer,
+		},
+		{
+			name:     "content parts",
+			messages: `[{"role":"user","content":[{"type":"text","text":"hello world"},{"type":"image_url","image_url":{"url":"data:"}}]}]`,
+			want:     tokensPerMessage + user + hello + tokensPerImage + tokensReplyPrimer,
+		},
+		{
+			name:     "name",
+			messages: `[{"role":"user","name":"hello world","content":null}]`,
+			want:     tokensPerMessage + user + tokensPerName + hello + tokensReplyPrimer,
+		},
+		{
+			name:     "tool calls",
+			messages: `[{"role":"assistant","content":null,"tool_calls":[{"id":"x","type":"function","function":{"name":"hello world","arguments":"hello world"}}]}]`,
+			want:     tokensPerMessage + Count("gpt-4", "assistant") + 2*hello + tokensReplyPrimer,
+		},
+		{
+			name:     "not an array",
+			messages: `{"role":"user"}`,
+			want:     0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CountMessages("gpt-4", json.RawMessage(test.messages)); got != test.want {
+				t.Fatalf("CountMessages = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCountTools(t *testing.T) {
+	if got := CountTools("gpt-4", nil); got != 0 {
+		t.Fatalf("CountTools(nil) = %d", got)
+	}
+	if got := CountTools("gpt-4", json.RawMessage("null")); got != 0 {
+		t.Fatalf("CountTools(null) = %d", got)
+	}
+	tools := `[{"type":"function","function":{"name":"weather"}}]`
+	if got := CountTools("gpt-4", json.RawMessage(tools)); got != Count("gpt-4", tools) {
+		t.Fatalf("CountTools = %d, want %d", got, Count("gpt-4", tools))
+	}
+}
+
+func TestCountInput(t *testing.T) {
+	var input interface{}
+	if err := json.Unmarshal([]byte(`["hello world", [1, 2, 3], 4]`), &input); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := CountInput("gpt-4", input), Count("gpt-4", "hello world")+4; got != want {
+		t.Fatalf("CountInput = %d, want %d", got, want)
+	}
+	if got := CountInput("gpt-4", map[string]interface{}{}); got != 0 {
+		t.Fatalf("CountInput(object) = %d", got)
+	}
+}
@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"copilot-gpt4-service/log"
+)
+
+const serviceName = "copilot-gpt4-service"
+
+// Exporters the spans can be sent to.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+)
+
+// Attributes of the spans that are specific to this service, named after the
+// OpenTelemetry semantic conventions for generative AI where there is one.
+const (
+	AttrModel            = "gen_ai.request.model"
+	AttrPromptTokens     = "gen_ai.usage.input_tokens"
+	AttrCompletionTokens = "gen_ai.usage.output_tokens"
+	AttrStream           = "copilot.stream"
+	AttrStreamDuration   = "copilot.stream.duration_ms"
+	AttrCacheHit         = "copilot.cache.hit"
+)
+
+// Tracer returns the tracer of the service. It does nothing until Init set up an exporter.
+func Tracer() trace.Tracer {
+	return otel.Tracer(serviceName)
+}
+
+// Start a span as a child of the span in the context, if any.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// Propagator reads and writes the W3C traceparent and baggage headers.
+func Propagator() propagation.TextMapPropagator {
+	return otel.GetTextMapPropagator()
+}
+
+// Set up the exporter and register the tracer provider globally. exporter is one of
+// none, stdout, file or otlp; path is the file the spans are appended to for the file
+// exporter. The otlp exporter is configured by the standard OTEL_EXPORTER_OTLP_*
+// environment variables. The returned function flushes the spans and must be called
+// before the service exits.
+func Init(exporter string, path string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, err
+		}
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(context.Background())
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, optional values: none, stdout, file, otlp", exporter)
+	}
+	if err != nil {
+		closeFile(file)
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		closeFile(file)
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.ZLog.Log.Warn().Err(err).Msg("Tracing error")
+	}))
+	return func(ctx context.Context) error {
+		// the file is closed only after the provider flushed the remaining spans to it
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Close the file of the file exporter, if it was opened.
+func closeFile(file *os.File) {
+	if file != nil {
+		file.Close()
+	}
+}
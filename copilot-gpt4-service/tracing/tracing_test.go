@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInitNone(t *testing.T) {
+	for _, exporter := range []string{"", ExporterNone} {
+		shutdown, err := Init(exporter, "")
+		if err != nil {
+			t.Fatalf("exporter %q: %v", exporter, err)
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Fatalf("exporter %q: shutdown: %v", exporter, err)
+		}
+	}
+}
+
+func TestInitUnknown(t *testing.T) {
+	if _, err := Init("jaeger", ""); err == nil || !strings.Contains(err.Error(), "jaeger") {
+		t.Fatalf("expected an error naming the unknown exporter, got %v", err)
+	}
+}
+
+func TestInitFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces", "spans.json")
+	shutdown, err := Init(ExporterFile, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "test span")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Name":"test span"`) {
+		t.Fatalf("the span is not flushed to the file:\n%s", data)
+	}
+}
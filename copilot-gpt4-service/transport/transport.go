@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"copilot-gpt4-service/config"
+)
+
+// Idle connections kept open for reuse, in total and by host. Most requests go to the
+// GitHub Copilot API, so it may keep most of them.
+const (
+	maxIdleConns        = 100
+	maxIdleConnsPerHost = 32
+)
+
+// Options of the outbound HTTP client.
+type Options struct {
+	// URL of the proxy, http://, https:// or socks5://, with the credentials if any.
+	// Empty uses HTTPS_PROXY, HTTP_PROXY and NO_PROXY of the environment.
+	Proxy string
+	// Timeout of establishing a connection.
+	DialTimeout time.Duration
+	// Timeout of the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// Timeout of waiting for the response headers once the request is sent, not of
+	// reading the body, which may be a long stream.
+	ResponseHeaderTimeout time.Duration
+	// How long an idle connection is kept open for reuse.
+	IdleConnTimeout time.Duration
+}
+
+// Create an HTTP client that reuses its connections, negotiates HTTP/2 where the
+// server supports it, and sends the requests through the proxy of the options.
+func New(options Options) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if options.Proxy != "" {
+		proxyURL, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q, expected http, https or socks5", proxyURL.Scheme)
+		}
+		if proxyURL.Host == "" {
+			return nil, fmt.Errorf("the proxy %q has no host", options.Proxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   options.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          maxIdleConns,
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+			IdleConnTimeout:       options.IdleConnTimeout,
+			TLSHandshakeTimeout:   options.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: options.ResponseHeaderTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+	}, nil
+}
+
+// Return the options of the configuration.
+func configuredOptions() Options {
+	cfg := config.ConfigInstance
+	return Options{
+		Proxy:                 cfg.OutboundProxy,
+		DialTimeout:           time.Duration(cfg.OutboundDialTimeout) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(cfg.OutboundTLSTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(cfg.OutboundRespTimeout) * time.Second,
+		IdleConnTimeout:       time.Duration(cfg.OutboundIdleTimeout) * time.Second,
+	}
+}
+
+// Create the client of the configuration, an error if the proxy is invalid.
+func NewConfiguredClient() (*http.Client, error) {
+	return New(configuredOptions())
+}
+
+// ClientInstance sends every outbound request: to GitHub, to the GitHub Copilot API and
+// of the CORS proxy, so that they share the connections and the proxy. The service creates
+// it once the configuration is loaded, and does not start if the proxy is invalid.
+var ClientInstance *http.Client = http.DefaultClient
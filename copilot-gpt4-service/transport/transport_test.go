@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"copilot-gpt4-service/config"
+)
+
+var testOptions = Options{
+	DialTimeout:           time.Second,
+	TLSHandshakeTimeout:   time.Second,
+	ResponseHeaderTimeout: time.Second,
+	IdleConnTimeout:       time.Second,
+}
+
+func get(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("proxied " + r.URL.Host + " " + r.Header.Get("Proxy-Authorization")))
+	}))
+	defer proxy.Close()
+
+	options := testOptions
+	options.Proxy = "http://user:secret@" + proxy.Listener.Addr().String()
+	client, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := get(t, client, "http://api.github.invalid/copilot"); body != "proxied api.github.invalid Basic dXNlcjpzZWNyZXQ=" {
+		t.Fatalf("request not sent through the proxy: %q", body)
+	}
+}
+
+// Serve a single SOCKS5 CONNECT without authentication and report the address asked for.
+func serveSOCKS5(listener net.Listener, requested chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, 262)
+	// greeting: version, methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte{5, 0})
+	// request: version, command, reserved, address type, address, port
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	host := ""
+	switch buf[3] {
+	case 1:
+		_, _ = io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		_, _ = io.ReadFull(conn, buf[:1])
+		n := int(buf[0])
+		_, _ = io.ReadFull(conn, buf[:n])
+		host = string(buf[:n])
+	default:
+		return
+	}
+	_, _ = io.ReadFull(conn, buf[:2])
+	requested <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	// answer the tunneled request
+	_, _ = conn.Read(buf)
+	_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\ntunnel"))
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	requested := make(chan string, 1)
+	go serveSOCKS5(listener, requested)
+
+	options := testOptions
+	options.Proxy = "socks5://" + listener.Addr().String()
+	client, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := get(t, client, "http://api.github.invalid:8080/copilot"); body != "tunnel" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if address := <-requested; address != "api.github.invalid:8080" {
+		t.Fatalf("unexpected address asked to the proxy: %s", address)
+	}
+}
+
+func TestInvalidProxy(t *testing.T) {
+	for _, proxy := range []string{"ftp://proxy:21", "http://", "://broken"} {
+		options := testOptions
+		options.Proxy = proxy
+		if _, err := New(options); err == nil {
+			t.Fatalf("expected the proxy %q to be rejected", proxy)
+		}
+	}
+
+	// an invalid configured proxy is an error, the proxy of the environment is not used instead
+	saved := config.ConfigInstance.OutboundProxy
+	defer func() { config.ConfigInstance.OutboundProxy = saved }()
+	config.ConfigInstance.OutboundProxy = "ftp://proxy:21"
+	if client, err := NewConfiguredClient(); err == nil || client != nil {
+		t.Fatal("expected the configured proxy to be rejected")
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	options := testOptions
+	options.ResponseHeaderTimeout = 50 * time.Millisecond
+	client, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(server.URL)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestConnectionReuseAndHTTP2(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := New(testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	for i := 0; i < 3; i++ {
+		if proto := get(t, client, server.URL); proto != "HTTP/2.0" {
+			t.Fatalf("expected HTTP/2, got %s", proto)
+		}
+	}
+	if n := connections.Load(); n != 1 {
+		t.Fatalf("expected the connection to be reused, got %d connections", n)
+	}
+}
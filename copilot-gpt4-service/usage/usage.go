@@ -0,0 +1,152 @@
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+
+	"copilot-gpt4-service/cache"
+	"copilot-gpt4-service/log"
+)
+
+var ErrInvalidGroup = errors.New("invalid group")
+
+// LedgerInstance is a global variable that is used to access the usage ledger, created by the
+// service once the configuration is loaded.
+var LedgerInstance *Ledger
+
+// Record is the usage of a single completion or embedding call.
+type Record struct {
+	ID               int64  `db:"id" json:"id"`
+	CreatedAt        int64  `db:"created_at" json:"created_at"`
+	Identity         string `db:"identity" json:"identity"`
+	KeyID            string `db:"key_id" json:"key_id"`
+	Endpoint         string `db:"endpoint" json:"endpoint"`
+	Model            string `db:"model" json:"model"`
+	Stream           bool   `db:"stream" json:"stream"`
+	PromptTokens     int    `db:"prompt_tokens" json:"prompt_tokens"`
+	CompletionTokens int    `db:"completion_tokens" json:"completion_tokens"`
+	LatencyMs        int64  `db:"latency_ms" json:"latency_ms"`
+	Status           int    `db:"status" json:"status"`
+}
+
+// Dimensions the usage can be aggregated by, mapped to their SQL expression.
+var groupColumns = map[string]string{
+	"key":   "CASE WHEN key_id != '' THEN key_id ELSE identity END",
+	"model": "model",
+	"day":   "strftime('%Y-%m-%d', created_at, 'unixepoch')",
+}
+
+// GroupColumns lists the valid dimensions in their output order.
+var GroupColumns = []string{"key", "model", "day"}
+
+// Query selects and groups the usage records. From and To are unix timestamps, 0 means unbounded.
+type Query struct {
+	GroupBy []string
+	From    int64
+	To      int64
+}
+
+// Summary is the aggregated usage of a group. Only the dimensions grouped by are set.
+type Summary struct {
+	Key              string  `db:"key" json:"key,omitempty"`
+	Model            string  `db:"model" json:"model,omitempty"`
+	Day              string  `db:"day" json:"day,omitempty"`
+	Requests         int64   `db:"requests" json:"requests"`
+	Errors           int64   `db:"errors" json:"errors"`
+	PromptTokens     int64   `db:"prompt_tokens" json:"prompt_tokens"`
+	CompletionTokens int64   `db:"completion_tokens" json:"completion_tokens"`
+	TotalTokens      int64   `db:"total_tokens" json:"total_tokens"`
+	AvgLatencyMs     float64 `db:"avg_latency_ms" json:"avg_latency_ms"`
+}
+
+// Ledger keeps the usage records in the cache database.
+type Ledger struct {
+	mu    sync.Mutex
+	cache *cache.Cache
+	Db    *sqlx.DB
+}
+
+// Create a new Ledger instance.
+func NewLedger(c *cache.Cache) *Ledger {
+	return &Ledger{cache: c}
+}
+
+// Connect to the cache database, the table is created by its migrations.
+func (l *Ledger) connect() (*sqlx.DB, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Db != nil {
+		return l.Db, nil
+	}
+
+	db, err := l.cache.DB()
+	if err != nil {
+		return nil, err
+	}
+	l.Db = db
+	return l.Db, nil
+}
+
+// Record the usage of a call.
+func (l *Ledger) Record(record Record) error {
+	db, err := l.connect()
+	if err != nil {
+		return err
+	}
+	_, err = db.NamedExec(`INSERT INTO usage (created_at, identity, key_id, endpoint, model, stream, prompt_tokens, completion_tokens, latency_ms, status)
+		VALUES (:created_at, :identity, :key_id, :endpoint, :model, :stream, :prompt_tokens, :completion_tokens, :latency_ms, :status)`, record)
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Insert usage record failed")
+	}
+	return err
+}
+
+// Aggregate the usage records of the query.
+func (l *Ledger) Summarize(query Query) ([]Summary, error) {
+	db, err := l.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	selects := make([]string, 0)
+	groups := make([]string, 0)
+	for _, name := range query.GroupBy {
+		column, ok := groupColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s, valid groups are %s", ErrInvalidGroup, name, strings.Join(GroupColumns, ", "))
+		}
+		selects = append(selects, column+" AS "+name)
+		groups = append(groups, name)
+	}
+	selects = append(selects,
+		"COUNT(*) AS requests",
+		"SUM(CASE WHEN status >= 400 THEN 1 ELSE 0 END) AS errors",
+		"SUM(prompt_tokens) AS prompt_tokens",
+		"SUM(completion_tokens) AS completion_tokens",
+		"SUM(prompt_tokens + completion_tokens) AS total_tokens",
+		"AVG(latency_ms) AS avg_latency_ms",
+	)
+
+	sql := "SELECT " + strings.Join(selects, ", ") + " FROM usage WHERE created_at >= ?"
+	args := []interface{}{query.From}
+	if query.To > 0 {
+		sql += " AND created_at < ?"
+		args = append(args, query.To)
+	}
+	if len(groups) > 0 {
+		sql += " GROUP BY " + strings.Join(groups, ", ") + " ORDER BY " + strings.Join(groups, ", ")
+	} else {
+		// without grouping an empty ledger still returns one row of NULLs
+		sql += " HAVING COUNT(*) > 0"
+	}
+
+	summaries := make([]Summary, 0)
+	if err := db.Select(&summaries, sql, args...); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
@@ -0,0 +1,112 @@
+package usage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"copilot-gpt4-service/cache"
+	"copilot-gpt4-service/log"
+)
+
+const testKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+func newLedger(t *testing.T) *Ledger {
+	t.Helper()
+	c := cache.NewCache("sqlite://"+t.TempDir()+"/cache.sqlite3", testKey, "")
+	t.Cleanup(c.Close)
+	return NewLedger(c)
+}
+
+// Unix timestamps of the test records, two days apart.
+var (
+	day1 = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).Unix()
+	day2 = time.Date(2024, 3, 3, 12, 0, 0, 0, time.UTC).Unix()
+)
+
+func record(t *testing.T, l *Ledger, records ...Record) {
+	t.Helper()
+	for _, r := range records {
+		if err := l.Record(r); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+}
+
+func fixture(t *testing.T) *Ledger {
+	t.Helper()
+	l := newLedger(t)
+	record(t, l,
+		Record{CreatedAt: day1, Identity: "key:key-a", KeyID: "key-a", Model: "gpt-4", PromptTokens: 10, CompletionTokens: 5, LatencyMs: 100, Status: 200},
+		Record{CreatedAt: day1, Identity: "key:key-a", KeyID: "key-a", Model: "gpt-4", PromptTokens: 20, CompletionTokens: 0, LatencyMs: 300, Status: 502},
+		Record{CreatedAt: day2, Identity: "ip:10.0.0.1", Model: "gpt-4o", PromptTokens: 1, CompletionTokens: 2, LatencyMs: 50, Status: 200},
+	)
+	return l
+}
+
+func TestSummarizeTotal(t *testing.T) {
+	summaries, err := fixture(t).Summarize(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("unexpected summaries: %+v", summaries)
+	}
+	s := summaries[0]
+	if s.Requests != 3 || s.Errors != 1 || s.PromptTokens != 31 || s.CompletionTokens != 7 || s.TotalTokens != 38 || s.AvgLatencyMs != 150 {
+		t.Fatalf("unexpected summary: %+v", s)
+	}
+}
+
+func TestSummarizeGroups(t *testing.T) {
+	summaries, err := fixture(t).Summarize(Query{GroupBy: []string{"key", "model", "day"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("unexpected summaries: %+v", summaries)
+	}
+	// callers without an API key are reported by their identity
+	first, second := summaries[0], summaries[1]
+	if first.Key != "ip:10.0.0.1" || first.Model != "gpt-4o" || first.Day != "2024-03-03" || first.Requests != 1 {
+		t.Fatalf("unexpected summary: %+v", first)
+	}
+	if second.Key != "key-a" || second.Model != "gpt-4" || second.Day != "2024-03-01" || second.Requests != 2 || second.TotalTokens != 35 {
+		t.Fatalf("unexpected summary: %+v", second)
+	}
+}
+
+func TestSummarizeRange(t *testing.T) {
+	l := fixture(t)
+	summaries, err := l.Summarize(Query{GroupBy: []string{"day"}, From: day1 + 1})
+	if err != nil || len(summaries) != 1 || summaries[0].Day != "2024-03-03" {
+		t.Fatalf("unexpected summaries from: %+v, %v", summaries, err)
+	}
+	summaries, err = l.Summarize(Query{GroupBy: []string{"day"}, To: day2})
+	if err != nil || len(summaries) != 1 || summaries[0].Day != "2024-03-01" {
+		t.Fatalf("unexpected summaries to: %+v, %v", summaries, err)
+	}
+}
+
+func TestSummarizeEmpty(t *testing.T) {
+	l := newLedger(t)
+	for _, groups := range [][]string{nil, {"model"}} {
+		summaries, err := l.Summarize(Query{GroupBy: groups})
+		if err != nil || len(summaries) != 0 {
+			t.Fatalf("unexpected summaries of an empty ledger grouped by %v: %+v, %v", groups, summaries, err)
+		}
+	}
+}
+
+func TestSummarizeInvalidGroup(t *testing.T) {
+	if _, err := newLedger(t).Summarize(Query{GroupBy: []string{"identity; DROP TABLE usage"}}); !errors.Is(err, ErrInvalidGroup) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -3,16 +3,31 @@ package utils
 import (
 	"copilot-gpt4-service/cache"
 	"copilot-gpt4-service/config"
+	"copilot-gpt4-service/keys"
 	"copilot-gpt4-service/log"
+	"copilot-gpt4-service/metrics"
+	"copilot-gpt4-service/openai"
+	"copilot-gpt4-service/pool"
+	"copilot-gpt4-service/tracing"
+	"copilot-gpt4-service/transport"
 
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"math/rand"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 type Authorization struct {
@@ -20,14 +35,17 @@ type Authorization struct {
 	ExpiresAt int64  `json:"expires_at"`
 }
 
-var superTokenMap = make(map[string]bool)
-
-func init() {
-	if config.ConfigInstance.SuperToken != "" && config.ConfigInstance.EnableSuperToken {
-		for _, token := range strings.Split(config.ConfigInstance.SuperToken, ",") {
-			superTokenMap[token] = true
+// Whether the token is one of the super tokens, which are served by the token pool.
+func isSuperToken(token string) bool {
+	if !config.ConfigInstance.EnableSuperToken || config.ConfigInstance.SuperToken == "" {
+		return false
+	}
+	for _, superToken := range strings.Split(config.ConfigInstance.SuperToken, ",") {
+		if token == superToken {
+			return true
 		}
 	}
+	return false
 }
 
 // Set the Authorization in the cache.
@@ -40,73 +58,436 @@ func setAuthorizationToCache(copilotToken string, authorization Authorization) {
 }
 
 // Obtain the Authorization from the cache.
-func getAuthorizationFromCache(copilotToken string) *Authorization {
+func getAuthorizationFromCache(ctx context.Context, copilotToken string) *Authorization {
+	_, span := tracing.Start(ctx, "cache.get")
+	defer span.End()
+
 	extraTime := rand.Intn(600) + 300
 	if authorization, ok := cache.CacheInstance.Get(copilotToken); ok {
 		if authorization.ExpiresAt > time.Now().Unix()+int64(extraTime) {
+			span.SetAttributes(attribute.Bool(tracing.AttrCacheHit, true))
 			return &Authorization{Token: authorization.C_token, ExpiresAt: authorization.ExpiresAt}
 		}
 	}
+	span.SetAttributes(attribute.Bool(tracing.AttrCacheHit, false))
 	return &Authorization{}
 }
 
-// When obtaining the Authorization, first attempt to retrieve it from the cache. If it is not available in the cache, retrieve it through an HTTP request and then set it in the cache.
-func GetAuthorizationFromToken(copilotToken string) (string, int, string) {
-	authorization := getAuthorizationFromCache(copilotToken)
-	if authorization == nil || authorization.Token == "" {
-		getAuthorizationUrl := "https://api.github.com/copilot_internal/v2/token"
-		client := &http.Client{}
-		req, err := http.NewRequest("GET", getAuthorizationUrl, nil)
-		if err != nil {
-			log.ZLog.Log.Error().Err(err).Msg("Failed to create request: " + getAuthorizationUrl)
-			return "", http.StatusInternalServerError, err.Error()
-		}
-		req.Header.Set("Authorization", "token "+copilotToken)
-		response, err := client.Do(req)
-		if err != nil {
-			log.ZLog.Log.Error().Err(err).Msg("Get GithubCopilot Authorization Token Failed, Request: " + getAuthorizationUrl)
-			return "", http.StatusInternalServerError, err.Error()
+// Exchange the GitHub Copilot Plugin Token for a Copilot token through the GitHub API.
+func requestAuthorization(ctx context.Context, copilotToken string) (*Authorization, int, string) {
+	getAuthorizationUrl := config.ConfigInstance.GitHubAPIURL("/copilot_internal/v2/token")
+	ctx, span := tracing.Start(ctx, "copilot.token_exchange", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String("GET"), semconv.URLFull(getAuthorizationUrl)))
+	defer span.End()
+	fail := func(statusCode int, msg string) (*Authorization, int, string) {
+		metrics.TokenRefresh(false)
+		span.SetStatus(codes.Error, msg)
+		return nil, statusCode, msg
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", getAuthorizationUrl, nil)
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Failed to create request: " + getAuthorizationUrl)
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	req.Header.Set("Authorization", "token "+copilotToken)
+	response, err := transport.ClientInstance.Do(req)
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Get GithubCopilot Authorization Token Failed, Request: " + getAuthorizationUrl)
+		metrics.UpstreamError(metrics.EndpointToken, 0)
+		span.RecordError(err)
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	defer response.Body.Close()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Failed to read getAuthorization response body")
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	if response.StatusCode != 200 {
+		log.ZLog.Log.Error().Msgf("Get GithubCopilot Authorization Token Failed, StatusCode: %d, Body: %s", response.StatusCode, string(body))
+		metrics.UpstreamError(metrics.EndpointToken, response.StatusCode)
+		return fail(response.StatusCode, string(body))
+	}
+
+	newAuthorization := &Authorization{}
+	if err = json.Unmarshal(body, &newAuthorization); err != nil {
+		log.ZLog.Log.Error().Err(err).Msg("Get GithubCopilot Authorization Token Failed, Json Unmarshal Failed")
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	if newAuthorization.Token == "" {
+		msg := "Get GithubCopilot Authorization Token Failed, Token is empty"
+		log.ZLog.Log.Error().Msg(msg)
+		return fail(http.StatusInternalServerError, msg)
+	}
+	metrics.TokenRefresh(true)
+	return newAuthorization, http.StatusOK, ""
+}
+
+// Backoff of the token exchange after a failure, doubled on every consecutive failure.
+const (
+	exchangeBackoffMin = 5 * time.Second
+	exchangeBackoffMax = 5 * time.Minute
+)
+
+// A failed token exchange, answered from memory until the backoff is over.
+type exchangeFailure struct {
+	statusCode int
+	errorInfo  string
+	failures   int
+	until      time.Time
+}
+
+// The result of a token exchange, shared by the callers waiting on it.
+type exchangeResult struct {
+	authorization *Authorization
+	statusCode    int
+	errorInfo     string
+}
+
+// Token exchanges in flight and the recent failures, by GitHub Copilot Plugin Token.
+var exchanges = struct {
+	group singleflight.Group
+	sync.Mutex
+	failures map[string]*exchangeFailure
+}{failures: make(map[string]*exchangeFailure)}
+
+// Return the failure of the token exchange if it is still backing off.
+func recentFailure(copilotToken string) (exchangeFailure, bool) {
+	exchanges.Lock()
+	defer exchanges.Unlock()
+	failure, ok := exchanges.failures[copilotToken]
+	if !ok || time.Now().After(failure.until) {
+		return exchangeFailure{}, false
+	}
+	return *failure, true
+}
+
+// Record the outcome of a token exchange. A failure backs off twice as long as the previous
+// one, unless the previous one is long over.
+func recordExchange(copilotToken string, result exchangeResult) {
+	exchanges.Lock()
+	defer exchanges.Unlock()
+	if result.authorization != nil {
+		delete(exchanges.failures, copilotToken)
+		return
+	}
+	// Forget the failures that are long over, tokens that are not used again would pile up
+	for token, failure := range exchanges.failures {
+		if time.Since(failure.until) > exchangeBackoffMax {
+			delete(exchanges.failures, token)
 		}
-		defer response.Body.Close()
+	}
+	failure, ok := exchanges.failures[copilotToken]
+	if !ok {
+		failure = &exchangeFailure{}
+		exchanges.failures[copilotToken] = failure
+	}
+	backoff := exchangeBackoffMin << failure.failures
+	if backoff > exchangeBackoffMax || backoff <= 0 {
+		backoff = exchangeBackoffMax
+	} else {
+		failure.failures++
+	}
+	failure.statusCode, failure.errorInfo = result.statusCode, result.errorInfo
+	failure.until = time.Now().Add(backoff)
+	log.ZLog.Log.Warn().Msgf("Github Copilot Authorization Token exchange failed, retrying not before %s", backoff)
+}
 
-		body, err := io.ReadAll(response.Body)
-		if err != nil {
-			log.ZLog.Log.Error().Err(err).Msg("Failed to read getAuthorization response body")
-			return "", http.StatusInternalServerError, err.Error()
+// Exchange the GitHub Copilot Plugin Token and set the Copilot token in the cache. Concurrent
+// exchanges of the same token share one upstream call, and a failure is answered from memory
+// until its backoff is over, so that a burst of requests does not become a burst of exchanges.
+func exchangeAuthorization(ctx context.Context, copilotToken string) (*Authorization, int, string) {
+	if failure, ok := recentFailure(copilotToken); ok {
+		return nil, failure.statusCode, failure.errorInfo
+	}
+
+	// The exchange outlives the caller that started it, the other callers still wait on it
+	ctx = context.WithoutCancel(ctx)
+	value, _, shared := exchanges.group.Do(copilotToken, func() (interface{}, error) {
+		authorization, statusCode, errorInfo := requestAuthorization(ctx, copilotToken)
+		result := exchangeResult{authorization, statusCode, errorInfo}
+		recordExchange(copilotToken, result)
+		if authorization != nil {
+			_, span := tracing.Start(ctx, "cache.set")
+			setAuthorizationToCache(copilotToken, *authorization)
+			span.End()
 		}
-		if response.StatusCode != 200 {
-			log.ZLog.Log.Error().Msgf("Get GithubCopilot Authorization Token Failed, StatusCode: %d, Body: %s", response.StatusCode, string(body))
-			return "", response.StatusCode, string(body)
+		return result, nil
+	})
+	if shared {
+		log.ZLog.Log.Debug().Msg("Shared a Github Copilot Authorization Token exchange with concurrent requests")
+	}
+	result := value.(exchangeResult)
+	return result.authorization, result.statusCode, result.errorInfo
+}
+
+// Tokens used within this window are kept fresh by RefreshAuthorizations.
+const activeWindow = time.Hour
+
+// getAuthorizationFromCache treats tokens expiring within up to 15 minutes as expired,
+// so they are refreshed before that.
+const refreshAhead = 15 * time.Minute
+
+// The GitHub Copilot Plugin Tokens in use and when they were last used.
+var activeTokens = struct {
+	sync.Mutex
+	lastUsed map[string]time.Time
+}{lastUsed: make(map[string]time.Time)}
+
+// Keep the token fresh, it must have been exchanged successfully, so that RefreshAuthorizations
+// does not exchange the tokens GitHub rejects over and over. Nothing is tracked if the refresh
+// is disabled, RefreshAuthorizations would never remove the tokens again.
+func touchToken(copilotToken string) {
+	if config.ConfigInstance.TokenRefreshInterval <= 0 {
+		return
+	}
+	activeTokens.Lock()
+	defer activeTokens.Unlock()
+	activeTokens.lastUsed[copilotToken] = time.Now()
+}
+
+// Refresh the Copilot tokens of the recently active GitHub Copilot Plugin Tokens that
+// expire before the next run, interval from now, so that no request waits on the token
+// exchange. Returns the number of tokens refreshed.
+func RefreshAuthorizations(ctx context.Context, interval time.Duration) int {
+	now := time.Now()
+	tokens := make([]string, 0)
+	activeTokens.Lock()
+	for token, lastUsed := range activeTokens.lastUsed {
+		if now.Sub(lastUsed) > activeWindow {
+			delete(activeTokens.lastUsed, token)
+			continue
 		}
+		tokens = append(tokens, token)
+	}
+	activeTokens.Unlock()
 
-		newAuthorization := &Authorization{}
-		if err = json.Unmarshal(body, &newAuthorization); err != nil {
-			log.ZLog.Log.Error().Err(err).Msg("Get GithubCopilot Authorization Token Failed, Json Unmarshal Failed")
-			return "", http.StatusInternalServerError, err.Error()
+	refreshed := 0
+	deadline := now.Add(refreshAhead + interval).Unix()
+	for _, token := range tokens {
+		if ctx.Err() != nil {
+			break
 		}
-		if newAuthorization.Token == "" {
-			msg := "Get GithubCopilot Authorization Token Failed, Token is empty"
-			log.ZLog.Log.Error().Msg(msg)
-			return "", http.StatusInternalServerError, msg
+		if authorization, ok := cache.CacheInstance.Peek(token); ok && authorization.ExpiresAt > deadline {
+			continue
+		}
+		newAuthorization, statusCode, _ := exchangeAuthorization(ctx, token)
+		if newAuthorization != nil {
+			refreshed++
+		} else if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+			// GitHub does not accept the token anymore, it is tracked again once it is exchanged successfully
+			activeTokens.Lock()
+			delete(activeTokens.lastUsed, token)
+			activeTokens.Unlock()
+		}
+	}
+	if refreshed > 0 {
+		log.ZLog.Log.Info().Msgf("Refreshed %d Github Copilot Authorization Tokens ahead of expiry", refreshed)
+	}
+	return refreshed
+}
+
+// When obtaining the Authorization, first attempt to retrieve it from the cache. If it is not available in the cache, retrieve it through an HTTP request and then set it in the cache.
+// Concurrent requests for the same token share the HTTP request, see exchangeAuthorization.
+func GetAuthorizationFromToken(ctx context.Context, copilotToken string) (string, int, string) {
+	authorization := getAuthorizationFromCache(ctx, copilotToken)
+	metrics.TokenCacheLookup(authorization.Token != "")
+	if authorization == nil || authorization.Token == "" {
+		newAuthorization, statusCode, errorInfo := exchangeAuthorization(ctx, copilotToken)
+		if newAuthorization == nil {
+			return "", statusCode, errorInfo
 		}
 
-		logMessage := "Token: " + newAuthorization.Token + ", ExpiresAt: " + time.Unix(newAuthorization.ExpiresAt, 0).Format("2006-01-02 15:04:05")
+		logMessage := "Token: " + log.Fingerprint(newAuthorization.Token) + ", ExpiresAt: " + time.Unix(newAuthorization.ExpiresAt, 0).Format("2006-01-02 15:04:05")
 		log.ZLog.Log.Debug().Msg("Get GithubCopilot Authorization Token Success, " + logMessage)
 		authorization.Token = newAuthorization.Token
-		log.ZLog.Log.Debug().Msg("Successfully obtained Github Copilot Authorization Token, will set in cache. " + logMessage)
-		setAuthorizationToCache(copilotToken, *newAuthorization)
 	}
+	touchToken(copilotToken)
 	return authorization.Token, http.StatusOK, ""
 }
 
+// Whether the GitHub Copilot Plugin Token was exchanged successfully and its Copilot token is still valid.
+func isExchangedToken(copilotToken string) bool {
+	authorization, ok := cache.CacheInstance.Peek(copilotToken)
+	return ok && authorization.C_token != "" && authorization.ExpiresAt > time.Now().Unix()
+}
+
+// Exchange the GitHub Copilot Plugin Token again after upstream rejected its Copilot token,
+// staleToken, e.g. because it was revoked before it expired. If a concurrent request already
+// replaced the token in the cache, its replacement is used instead of exchanging it again.
+func RenewAuthorization(ctx context.Context, copilotToken string, staleToken string) (string, int, string) {
+	if authorization, ok := cache.CacheInstance.Peek(copilotToken); ok &&
+		authorization.C_token != "" && authorization.C_token != staleToken && authorization.ExpiresAt > time.Now().Unix() {
+		return authorization.C_token, http.StatusOK, ""
+	}
+	newAuthorization, statusCode, errorInfo := exchangeAuthorization(ctx, copilotToken)
+	if newAuthorization == nil {
+		return "", statusCode, errorInfo
+	}
+	log.ZLog.Log.Info().Msg("Renewed the GithubCopilot Authorization Token rejected by upstream, ExpiresAt: " + time.Unix(newAuthorization.ExpiresAt, 0).Format("2006-01-02 15:04:05"))
+	return newAuthorization.Token, http.StatusOK, ""
+}
+
+// Keys of the pooled account, the API key and the token usage in the gin context.
+const (
+	accountContextKey   = "copilot_account"
+	apiKeyContextKey    = "api_key"
+	apiKeyErrContextKey = "api_key_error"
+	usageContextKey     = "usage"
+	modelContextKey     = "model"
+	streamContextKey    = "stream"
+)
+
 // Retrieve the GitHub Copilot Plugin Token from the request header.
+// If the token pool is configured, an account is taken from the pool instead
+// and must be given back with ReleaseAuthorization when the request is done.
+// API keys issued by this service are always resolved to an account of the pool.
 func GetAuthorization(c *gin.Context) (string, bool) {
 	copilotToken := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
-	if config.ConfigInstance.CopilotToken != "" &&
-		((config.ConfigInstance.EnableSuperToken && superTokenMap[copilotToken]) ||
+
+	isAPIKey := strings.HasPrefix(copilotToken, keys.SecretPrefix)
+	if isAPIKey {
+		key, err := lookupAPIKey(c, copilotToken)
+		if err != nil {
+			prefix := copilotToken
+			if len(prefix) > len(keys.SecretPrefix)+4 {
+				prefix = prefix[:len(keys.SecretPrefix)+4]
+			}
+			log.ZLog.Log.Warn().Err(err).Msg("Invalid API key, prefix: " + prefix)
+			return "", false
+		}
+		if pool.PoolInstance.Len() == 0 {
+			log.ZLog.Log.Error().Msg("API key " + key.ID + " is used, but neither COPILOT_TOKEN nor COPILOT_TOKENS is set")
+			return "", false
+		}
+	}
+
+	if pool.PoolInstance.Len() > 0 &&
+		(isAPIKey || isSuperToken(copilotToken) ||
 			!config.ConfigInstance.EnableSuperToken) {
-		return config.ConfigInstance.CopilotToken, true
+		account, err := pool.PoolInstance.Acquire()
+		if err != nil {
+			log.ZLog.Log.Error().Err(err).Msg("Acquire github copilot account failed")
+			return "", false
+		}
+		c.Set(accountContextKey, account)
+		return account.Token, true
 	}
 
 	return copilotToken, copilotToken != ""
 }
+
+// Look up the API key of the request once, the rate limiter and the handler share the result.
+func lookupAPIKey(c *gin.Context, secret string) (*keys.Key, error) {
+	if key := GetAPIKey(c); key != nil {
+		return key, nil
+	}
+	if err, ok := c.Value(apiKeyErrContextKey).(error); ok {
+		return nil, err
+	}
+	key, err := keys.StoreInstance.Lookup(secret)
+	if err != nil {
+		c.Set(apiKeyErrContextKey, err)
+		return nil, err
+	}
+	c.Set(apiKeyContextKey, key)
+	return key, nil
+}
+
+// Give the pooled account of the request back to the pool. statusCode is the
+// upstream status of the request, 0 if upstream was not reached.
+func ReleaseAuthorization(c *gin.Context, statusCode int) {
+	if account, ok := c.Value(accountContextKey).(*pool.Account); ok {
+		pool.PoolInstance.Release(account, statusCode)
+		c.Set(accountContextKey, nil)
+	}
+}
+
+// Switch the request to another account of the pool after upstream answered the current one
+// with statusCode: the current account is given back with that status and the request keeps
+// the new one, whose token is exchanged first. Returns false, and keeps the current account,
+// if the request is not served by the pool or no other account is available.
+func SwitchAuthorization(c *gin.Context, statusCode int) (string, bool) {
+	account, ok := c.Value(accountContextKey).(*pool.Account)
+	if !ok || account == nil {
+		return "", false
+	}
+	next, err := pool.PoolInstance.AcquireExcept(account)
+	if err != nil {
+		return "", false
+	}
+	if _, exchangeStatus, errorInfo := GetAuthorizationFromToken(c.Request.Context(), next.Token); errorInfo != "" {
+		log.ZLog.Log.Warn().Msgf("Switching to github copilot account #%d failed, status %d: %s", next.ID, exchangeStatus, errorInfo)
+		pool.PoolInstance.Release(next, exchangeStatus)
+		return "", false
+	}
+	log.ZLog.Log.Info().Msgf("Switched from github copilot account #%d to #%d after status %d", account.ID, next.ID, statusCode)
+	pool.PoolInstance.Release(account, statusCode)
+	c.Set(accountContextKey, next)
+	return next.Token, true
+}
+
+// Return the API key used by the request, nil if the request did not use one.
+func GetAPIKey(c *gin.Context) *keys.Key {
+	key, _ := c.Value(apiKeyContextKey).(*keys.Key)
+	return key
+}
+
+// Check the scopes of the API key used by the request, if any, against the
+// requested endpoint and model.
+func CheckKeyScope(c *gin.Context, model string) bool {
+	key := GetAPIKey(c)
+	if key == nil {
+		return true
+	}
+	return key.AllowsEndpoint(c.FullPath()) && key.AllowsModel(model)
+}
+
+// Return the identity of the caller, which the rate limits and the usage ledger are kept
+// by: the ID of a valid API key, a short hash of a super token or of a GitHub Copilot Plugin
+// Token that GitHub accepted, or else the client IP. Any other token is not authenticated and
+// could be changed on every request.
+func CallerIdentity(c *gin.Context) string {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	switch {
+	case token == "":
+	case strings.HasPrefix(token, keys.SecretPrefix):
+		if key, err := lookupAPIKey(c, token); err == nil {
+			return "key:" + key.ID
+		}
+	case isSuperToken(token):
+		sum := sha256.Sum256([]byte(token))
+		return "super:" + hex.EncodeToString(sum[:8])
+	case pool.PoolInstance.Len() > 0 && !config.ConfigInstance.EnableSuperToken:
+		// the token is ignored, every caller is served by the pool
+	case isExchangedToken(token):
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:8])
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// Record the token usage of the request, for the middlewares that account for it.
+func SetUsage(c *gin.Context, usage openai.Usage) {
+	c.Set(usageContextKey, usage)
+}
+
+// Return the token usage of the request, false if the handler did not record one.
+func GetUsage(c *gin.Context) (openai.Usage, bool) {
+	usage, ok := c.Value(usageContextKey).(openai.Usage)
+	return usage, ok
+}
+
+// Record the model and the stream mode requested by the caller.
+func SetRequestModel(c *gin.Context, model string, stream bool) {
+	c.Set(modelContextKey, model)
+	c.Set(streamContextKey, stream)
+}
+
+// Return the model and the stream mode requested by the caller.
+func GetRequestModel(c *gin.Context) (string, bool) {
+	return c.GetString(modelContextKey), c.GetBool(streamContextKey)
+}
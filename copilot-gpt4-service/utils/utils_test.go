@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"copilot-gpt4-service/cache"
+	"copilot-gpt4-service/config"
+	"copilot-gpt4-service/fakeupstream"
+	"copilot-gpt4-service/log"
+)
+
+func TestMain(m *testing.M) {
+	log.ZLog = log.New(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Point the token exchange at a fresh fake upstream with an empty cache and no tracked tokens.
+func setup(t *testing.T) *fakeupstream.Server {
+	t.Helper()
+	fake := fakeupstream.New()
+	upstream := httptest.NewServer(fake)
+	t.Cleanup(upstream.Close)
+
+	saved, savedCache := *config.ConfigInstance, cache.CacheInstance
+	config.ConfigInstance.GitHubAPIBase = upstream.URL
+	cache.CacheInstance = cache.NewCache("sqlite://"+t.TempDir()+"/cache.sqlite3", "", "")
+	t.Cleanup(func() {
+		cache.CacheInstance.Close()
+		*config.ConfigInstance, cache.CacheInstance = saved, savedCache
+	})
+
+	activeTokens.Lock()
+	activeTokens.lastUsed = make(map[string]time.Time)
+	activeTokens.Unlock()
+	exchanges.Lock()
+	exchanges.failures = make(map[string]*exchangeFailure)
+	exchanges.Unlock()
+	return fake
+}
+
+func isTracked(token string) bool {
+	activeTokens.Lock()
+	defer activeTokens.Unlock()
+	_, ok := activeTokens.lastUsed[token]
+	return ok
+}
+
+func TestOnlyExchangedTokensTracked(t *testing.T) {
+	fake := setup(t)
+	fake.SetAccounts("ghu_valid")
+	ctx := context.Background()
+
+	if _, status, _ := GetAuthorizationFromToken(ctx, "ghu_bogus"); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status of a bogus token: %d", status)
+	}
+	if isTracked("ghu_bogus") {
+		t.Fatal("a token GitHub rejected is tracked")
+	}
+	if _, status, _ := GetAuthorizationFromToken(ctx, "ghu_valid"); status != http.StatusOK {
+		t.Fatalf("unexpected status of a valid token: %d", status)
+	}
+	if !isTracked("ghu_valid") {
+		t.Fatal("a token exchanged successfully is not tracked")
+	}
+}
+
+func TestNoTokensTrackedWithoutRefresh(t *testing.T) {
+	fake := setup(t)
+	fake.SetAccounts("ghu_valid")
+	config.ConfigInstance.TokenRefreshInterval = 0
+
+	if _, status, _ := GetAuthorizationFromToken(context.Background(), "ghu_valid"); status != http.StatusOK {
+		t.Fatalf("unexpected status of a valid token: %d", status)
+	}
+	if isTracked("ghu_valid") {
+		t.Fatal("a token is tracked while the refresh is disabled")
+	}
+}
+
+func TestRefreshAuthorizations(t *testing.T) {
+	fake := setup(t)
+	fake.SetAccounts("ghu_valid")
+	fake.SetTokenTTL(20 * time.Minute)
+	ctx := context.Background()
+
+	GetAuthorizationFromToken(ctx, "ghu_valid")
+	GetAuthorizationFromToken(ctx, "ghu_bogus")
+	exchanged := fake.Calls(fakeupstream.EndpointToken)
+
+	// the token is not due before the next run
+	if refreshed := RefreshAuthorizations(ctx, time.Minute); refreshed != 0 {
+		t.Fatalf("refreshed %d tokens that are not due", refreshed)
+	}
+	// the token expires before the next run, the bogus one is never exchanged again
+	if refreshed := RefreshAuthorizations(ctx, 10*time.Minute); refreshed != 1 {
+		t.Fatalf("expected 1 refreshed token, got %d", refreshed)
+	}
+	if calls := fake.Calls(fakeupstream.EndpointToken) - exchanged; calls != 1 {
+		t.Fatalf("expected 1 exchange, got %d", calls)
+	}
+
+	// a token GitHub does not accept anymore is not refreshed again
+	fake.SetAccounts("ghu_other")
+	if refreshed := RefreshAuthorizations(ctx, 10*time.Minute); refreshed != 0 {
+		t.Fatalf("refreshed %d rejected tokens", refreshed)
+	}
+	if isTracked("ghu_valid") {
+		t.Fatal("a token GitHub rejected is still tracked")
+	}
+}
+
+func TestRefreshAuthorizationsInactive(t *testing.T) {
+	fake := setup(t)
+	activeTokens.Lock()
+	activeTokens.lastUsed["ghu_idle"] = time.Now().Add(-activeWindow - time.Minute)
+	activeTokens.Unlock()
+
+	if refreshed := RefreshAuthorizations(context.Background(), time.Minute); refreshed != 0 {
+		t.Fatalf("refreshed %d inactive tokens", refreshed)
+	}
+	if calls := fake.Calls(fakeupstream.EndpointToken); calls != 0 || isTracked("ghu_idle") {
+		t.Fatalf("the inactive token is still refreshed, %d exchanges", calls)
+	}
+}